@@ -14,6 +14,8 @@
 #include <lv2/urid/urid.h>
 #include <lv2/options/options.h>
 
+#include <jansson.h>
+
 #include <assert.h>
 #include <stdbool.h>
 #include <stdint.h>
@@ -32,19 +34,32 @@
 
 #define UI_URI "http://helander.network/lv2ui/madigan"
 
+/* Message protocol spoken with the server. The handshake is always in the
+   original pipe delimited format with a protocol field added, after that
+   messages are JSON objects with string values. */
+#define PROTOCOL_VERSION 2
+
 #define BUFFER_SIZE 2048
+#define MAX_FRAME_SIZE (16 * 1024 * 1024)
 
 #define STATE_RESET 0
 #define STATE_OPERATIONAL 1
 
 #define NMB_MIDICC  128
 #define NMB_PORT 512
+#define NMB_PENDING 16
 
 typedef struct {
   bool valid;
   float value;
 } CacheValue;
 
+/* A get request from the server waiting for the plugin to answer a patch:Get */
+typedef struct {
+  LV2_URID property;
+  char request[24];
+} PendingGet;
+
 typedef struct
 {
     int sockfd;
@@ -53,6 +68,7 @@ typedef struct
     LV2_URID_Map* map;
     LV2_URID_Unmap* unmap;
     LV2UI_Request_Value* request_value;
+    LV2UI_Touch* touch;
     LV2_Log_Logger logger;
     LV2_Options_Option* options;
 
@@ -61,6 +77,9 @@ typedef struct
 
     char uid[20];
     char plugin_uri[100];
+    char host[64];      // Identity hints sent in the handshake so the server
+    char instance[100]; // can give the instance the same alias every session
+    int ordinal;
     //char input_queue[100];
     int state;
     int patch_input_port;
@@ -68,8 +87,12 @@ typedef struct
 
     CacheValue midicc_cache[NMB_MIDICC];
     CacheValue control_input_cache[NMB_PORT]; // Index is port number so space for non control inputs are there but not used
+    PendingGet pending_get[NMB_PENDING];
+    int pending_next;
     LV2_URID patch_Get;
     LV2_URID patch_Set;
+    LV2_URID patch_Put;
+    LV2_URID patch_body;
     LV2_URID patch_property;
     LV2_URID patch_value;
     LV2_URID atom_eventTransfer;
@@ -79,8 +102,12 @@ typedef struct
     LV2_URID atom_Object;
     LV2_URID atom_String;
     LV2_URID atom_Int;
+    LV2_URID atom_Long;
     LV2_URID atom_Float;
+    LV2_URID atom_Double;
+    LV2_URID atom_Bool;
     LV2_URID atom_URID;
+    LV2_URID atom_URI;
     LV2_URID atom_Path;
     LV2_URID midi_MidiEvent;
 
@@ -100,6 +127,66 @@ void get_instance_id(char* buf, size_t bufsize) {
     snprintf(buf, bufsize, "%x-%x", (unsigned)pid, counter);
 }
 
+/* Lowest ordinal not taken by a live UI of the same plugin in this process,
+   released again in cleanup. Reopening a window gets its ordinal back, and
+   it is stable as long as the host opens plugin windows in the same order. */
+#define NMB_ORDINALS 64
+static struct { char uri[100]; uint64_t used; } plugin_ordinals[NMB_ORDINALS];
+
+static int get_plugin_ordinal(const char* plugin_uri) {
+    for (int i = 0; i < NMB_ORDINALS; i++) {
+        if (!plugin_ordinals[i].uri[0]) {
+            snprintf(plugin_ordinals[i].uri, sizeof(plugin_ordinals[i].uri), "%s", plugin_uri);
+        }
+        if (!strcmp(plugin_ordinals[i].uri, plugin_uri)) {
+            for (int ordinal = 0; ordinal < 64; ordinal++) {
+                if (!(plugin_ordinals[i].used & (UINT64_C(1) << ordinal))) {
+                    plugin_ordinals[i].used |= UINT64_C(1) << ordinal;
+                    return ordinal;
+                }
+            }
+            return 64;
+        }
+    }
+    return 0;
+}
+
+static void release_plugin_ordinal(const char* plugin_uri, int ordinal) {
+    if (ordinal < 0 || ordinal >= 64) return;
+    for (int i = 0; i < NMB_ORDINALS && plugin_ordinals[i].uri[0]; i++) {
+        if (!strcmp(plugin_ordinals[i].uri, plugin_uri)) {
+            plugin_ordinals[i].used &= ~(UINT64_C(1) << ordinal);
+            return;
+        }
+    }
+}
+
+/* The handshake is pipe delimited, keep '|' out of the hints */
+static void copy_hint(char* dest, size_t size, const char* src) {
+    snprintf(dest, size, "%s", src);
+    for (char* c = dest; *c; c++) {
+        if (*c == '|') *c = '/';
+    }
+}
+
+/* Host name, the window title the host gives the instance (typically the
+   track or plugin instance label) and the plugin ordinal */
+static void get_identity_hints(ThisUI* ui) {
+    char host[64] = "";
+    gethostname(host, sizeof(host) - 1);
+    copy_hint(ui->host, sizeof(ui->host), host);
+    ui->instance[0] = 0;
+    if (ui->options) {
+        LV2_URID window_title = ui->map->map(ui->map->handle, LV2_UI__windowTitle);
+        for (const LV2_Options_Option* o = ui->options; o->key; ++o) {
+            if (o->key == window_title && o->type == ui->atom_String) {
+                copy_hint(ui->instance, sizeof(ui->instance), (const char*)o->value);
+            }
+        }
+    }
+    ui->ordinal = get_plugin_ordinal(ui->plugin_uri);
+}
+
 
 static void find_ports(const char* plugin_uri, ThisUI* ui) {
     ui->patch_input_port = -1;
@@ -185,12 +272,33 @@ static int read_n(int fd, void *buf, size_t n) {
 */
 
 
-static int recv_frame(int sock, char* buf, uint32_t bufsize) {
+// Read one frame into a buffer of its size, NUL terminated, which the caller
+// frees. Frames larger than MAX_FRAME_SIZE are read and dropped, so the
+// stream stays in step, and give 0 with *out NULL. Returns -1 on error.
+static int recv_frame(int sock, char** out) {
     uint32_t netlen;
+    *out = NULL;
     if (recv(sock, &netlen, 4, MSG_WAITALL) != 4) return -1;
     uint32_t len = ntohl(netlen);
-    if (len > bufsize) return -1;
-    if (recv(sock, buf, len, MSG_WAITALL) != (ssize_t)len) return -1;
+    if (len > MAX_FRAME_SIZE) {
+        char drain[BUFFER_SIZE];
+        uint32_t left = len;
+        while (left > 0) {
+            uint32_t n = left < sizeof(drain) ? left : sizeof(drain);
+            if (recv(sock, drain, n, MSG_WAITALL) != (ssize_t)n) return -1;
+            left -= n;
+        }
+        fprintf(stderr, "Dropped %u byte message from server\n", len);
+        return 0;
+    }
+    char* buf = malloc(len + 1);
+    if (!buf) return -1;
+    if (len > 0 && recv(sock, buf, len, MSG_WAITALL) != (ssize_t)len) {
+        free(buf);
+        return -1;
+    }
+    buf[len] = '\0';
+    *out = buf;
     return len;
 }
 
@@ -267,6 +375,29 @@ static void dumpmem(void* start, int bytes_per_row, int rows)
 }
 */
 
+/* Ask the plugin for the value of a patch property, or all properties when property is 0.
+   The plugin answers with patch:Set or patch:Put which arrive through port_event. */
+static void request_patch_get(ThisUI* ui, LV2_URID property)
+{
+    if (ui->patch_input_port < 0) return;
+
+    LV2_Atom_Forge forge;
+    uint8_t buffer[1000];
+    LV2_Atom_Forge_Frame frame;
+
+    lv2_atom_forge_init(&forge, ui->map);
+
+    lv2_atom_forge_set_buffer(&forge, buffer, sizeof(buffer));
+    lv2_atom_forge_object(&forge, &frame, 0, ui->patch_Get);
+    if (property) {
+        lv2_atom_forge_key(&forge, ui->patch_property);
+        lv2_atom_forge_urid(&forge, property);
+    }
+    lv2_atom_forge_pop(&forge, &frame);
+
+    ui->write(ui->controller, ui->patch_input_port, ((LV2_Atom*)buffer)->size + sizeof(LV2_Atom), ui->atom_eventTransfer, buffer);
+}
+
 static LV2UI_Handle instantiate(const LV2UI_Descriptor* descriptor, const char* plugin_uri, const char* bundle_path,
     LV2UI_Write_Function write_function, LV2UI_Controller controller, LV2UI_Widget* widget,
     const LV2_Feature* const* features)
@@ -304,6 +435,7 @@ static LV2UI_Handle instantiate(const LV2UI_Descriptor* descriptor, const char*
     LV2_URID__map,        &ui->map,           true,
     LV2_URID__unmap,      &ui->unmap,           true,
     LV2_UI__requestValue, &ui->request_value, false,
+    LV2_UI__touch,        &ui->touch,         false,
     LV2_OPTIONS__options, &ui->options, false,
     NULL);
     // clang-format on
@@ -318,6 +450,8 @@ static LV2UI_Handle instantiate(const LV2UI_Descriptor* descriptor, const char*
 
     ui->patch_Get = ui->map->map(ui->map->handle, LV2_PATCH__Get);
     ui->patch_Set = ui->map->map(ui->map->handle, LV2_PATCH__Set);
+    ui->patch_Put = ui->map->map(ui->map->handle, LV2_PATCH__Put);
+    ui->patch_body = ui->map->map(ui->map->handle, LV2_PATCH__body);
     ui->patch_property = ui->map->map(ui->map->handle, LV2_PATCH__property);
     ui->patch_value = ui->map->map(ui->map->handle, LV2_PATCH__value);
     ui->atom_eventTransfer = ui->map->map(ui->map->handle, LV2_ATOM__eventTransfer);
@@ -327,11 +461,17 @@ static LV2UI_Handle instantiate(const LV2UI_Descriptor* descriptor, const char*
     ui->atom_Object = ui->map->map(ui->map->handle, LV2_ATOM__Object);
     ui->atom_String = ui->map->map(ui->map->handle, LV2_ATOM__String);
     ui->atom_Int = ui->map->map(ui->map->handle, LV2_ATOM__Int);
+    ui->atom_Long = ui->map->map(ui->map->handle, LV2_ATOM__Long);
     ui->atom_Float = ui->map->map(ui->map->handle, LV2_ATOM__Float);
+    ui->atom_Double = ui->map->map(ui->map->handle, LV2_ATOM__Double);
+    ui->atom_Bool = ui->map->map(ui->map->handle, LV2_ATOM__Bool);
     ui->atom_URID = ui->map->map(ui->map->handle, LV2_ATOM__URID);
+    ui->atom_URI = ui->map->map(ui->map->handle, LV2_ATOM__URI);
     ui->atom_Path = ui->map->map(ui->map->handle, LV2_ATOM__Path);
     ui->midi_MidiEvent = ui->map->map(ui->map->handle, LV2_MIDI__MidiEvent);
 
+    get_identity_hints(ui);
+
 /*
         if (ui->options) {
                 LV2_URID ui_scale   = ui->map->map (ui->map->handle, "http://lv2plug.in/ns/extensions/ui#scaleFactor");
@@ -348,19 +488,7 @@ static LV2UI_Handle instantiate(const LV2UI_Descriptor* descriptor, const char*
 
     lv2_atom_forge_init(&ui->forge, ui->map);
 
-    {
-       LV2_Atom_Forge forge;
-       uint8_t buffer[1000];
-       LV2_Atom_Forge_Frame frame;
-
-       lv2_atom_forge_init(&forge, ui->map);
-
-       lv2_atom_forge_set_buffer(&forge, buffer, sizeof(buffer));
-       lv2_atom_forge_object(&forge, &frame, 0, ui->patch_Get);
-       lv2_atom_forge_pop(&forge, &frame);
-
-       ui->write(ui->controller, ui->patch_input_port, ((LV2_Atom*)buffer)->size + sizeof(LV2_Atom), ui->atom_eventTransfer, buffer);
-    }
+    request_patch_get(ui, 0);
 
 
 
@@ -371,46 +499,163 @@ static void cleanup(LV2UI_Handle handle)
 {
     ThisUI* ui = (ThisUI*)handle;
 
+    if (ui->sockfd != -1) {
+        close(ui->sockfd);
+        ui->sockfd = -1;
+    }
+    release_plugin_ordinal(ui->plugin_uri, ui->ordinal);
     free(ui);
 }
 
+/* Report a parameter value to the server so it can keep its state cache up to date. */
+static void report_value(ThisUI* ui, const char* type, const char* key, const char* kind, const char* value, const char* request)
+{
+    if (ui->sockfd == -1 || ui->state != STATE_OPERATIONAL) return;
+
+    json_t* report = json_pack("{s:s, s:s, s:s, s:s, s:s}",
+        "source", ui->uid, "type", type, "key", key, "kind", kind, "value", value);
+    if (!report) {
+        printf("\nFailed to encode report %s %s", type, key);fflush(stdout);
+        return;
+    }
+    if (request && *request) {
+        json_object_set_new(report, "request", json_string(request));
+    }
+    char* message = json_dumps(report, JSON_COMPACT);
+    json_decref(report);
+    if (!message) return;
+
+    printf("\nreport_value:MESSAGE %s", message);fflush(stdout);
+    if (send_message(ui->sockfd, message, strlen(message))) {
+        printf("\nFailed to report %s %s", type, key);fflush(stdout);
+    }
+    free(message);
+}
+
+/* Answer a request from the server with an error. */
+static void report_error(ThisUI* ui, const char* request, const char* error)
+{
+    if (ui->sockfd == -1 || ui->state != STATE_OPERATIONAL || !request) return;
+
+    json_t* report = json_pack("{s:s, s:s, s:s}", "source", ui->uid, "request", request, "error", error);
+    if (!report) return;
+    char* message = json_dumps(report, JSON_COMPACT);
+    json_decref(report);
+    if (!message) return;
+
+    send_message(ui->sockfd, message, strlen(message));
+    free(message);
+}
+
+static void report_control(ThisUI* ui, int port_index, const char* request)
+{
+    char key[16];
+    char value[32];
+    snprintf(key, sizeof(key), "%d", port_index);
+    snprintf(value, sizeof(value), "%f", ui->control_input_cache[port_index].value);
+    report_value(ui, "control", key, "float", value, request);
+}
+
+static void report_midicc(ThisUI* ui, int cc, const char* request)
+{
+    char key[16];
+    char value[32];
+    snprintf(key, sizeof(key), "%d", cc);
+    snprintf(value, sizeof(value), "%d", (int)ui->midicc_cache[cc].value);
+    report_value(ui, "midicc", key, "int", value, request);
+}
+
+/* Render an atom value as text. Returns the value kind or NULL if the atom type is not supported. */
+static const char* format_atom(ThisUI* ui, const LV2_Atom* atom, char* buf, size_t bufsize)
+{
+    if (atom->type == ui->atom_Int) {
+        snprintf(buf, bufsize, "%d", ((const LV2_Atom_Int*)atom)->body);
+        return "int";
+    } else if (atom->type == ui->atom_Long) {
+        snprintf(buf, bufsize, "%lld", (long long)((const LV2_Atom_Long*)atom)->body);
+        return "long";
+    } else if (atom->type == ui->atom_Float) {
+        snprintf(buf, bufsize, "%f", ((const LV2_Atom_Float*)atom)->body);
+        return "float";
+    } else if (atom->type == ui->atom_Double) {
+        snprintf(buf, bufsize, "%f", ((const LV2_Atom_Double*)atom)->body);
+        return "double";
+    } else if (atom->type == ui->atom_Bool) {
+        snprintf(buf, bufsize, "%d", ((const LV2_Atom_Bool*)atom)->body ? 1 : 0);
+        return "bool";
+    } else if (atom->type == ui->atom_String) {
+        snprintf(buf, bufsize, "%s", (const char*)LV2_ATOM_BODY_CONST(atom));
+        return "string";
+    } else if (atom->type == ui->atom_Path) {
+        snprintf(buf, bufsize, "%s", (const char*)LV2_ATOM_BODY_CONST(atom));
+        return "path";
+    } else if (atom->type == ui->atom_URI) {
+        snprintf(buf, bufsize, "%s", (const char*)LV2_ATOM_BODY_CONST(atom));
+        return "uri";
+    } else if (atom->type == ui->atom_URID) {
+        snprintf(buf, bufsize, "%s", ui->unmap->unmap(ui->unmap->handle, ((const LV2_Atom_URID*)atom)->body));
+        return "urid";
+    }
+    printf("\n Unsupported atom type %s  size %d ", ui->unmap->unmap(ui->unmap->handle, atom->type), atom->size);
+    fflush(stdout);
+    return NULL;
+}
+
+/* Remember that the server waits for the value of a patch property. */
+static void add_pending_get(ThisUI* ui, LV2_URID property, const char* request)
+{
+    if (!request) return;
+    PendingGet* slot = &ui->pending_get[ui->pending_next];
+    ui->pending_next = (ui->pending_next + 1) % NMB_PENDING;
+    slot->property = property;
+    snprintf(slot->request, sizeof(slot->request), "%s", request);
+}
+
+static void report_property(ThisUI* ui, LV2_URID property, const LV2_Atom* value)
+{
+    char text[BUFFER_SIZE / 2];
+    const char* kind = format_atom(ui, value, text, sizeof(text));
+    const char* request = NULL;
+    for (int i = 0; i < NMB_PENDING; i++) {
+        if (ui->pending_get[i].property == property) {
+            ui->pending_get[i].property = 0;
+            request = ui->pending_get[i].request;
+            break;
+        }
+    }
+    if (kind) {
+        report_value(ui, "patch", ui->unmap->unmap(ui->unmap->handle, property), kind, text, request);
+    } else {
+        report_error(ui, request, "Unsupported value type");
+    }
+}
+
 static void
 an_object(ThisUI* ui, LV2_Atom_Object* obj)
 {
-    char message[1000];          
-    sprintf(message, "source|%s||object|%s", ui->uid, ui->unmap->unmap(ui->unmap->handle, obj->body.otype));
-    LV2_ATOM_OBJECT_FOREACH(obj, p)
-    {
-        if (p->value.type == ui->atom_Int) {
-            LV2_Atom_Int* intAtom = (LV2_Atom_Int*)&p->value;
-            sprintf(message + strlen(message), "key|%s|type|integer|value|%d|", ui->unmap->unmap(ui->unmap->handle, p->key), intAtom->body);
-        } else if (p->value.type == ui->atom_Float) {
-            LV2_Atom_Float* floatAtom = (LV2_Atom_Float*)&p->value;
-            sprintf(message + strlen(message), "key|%s|type|float|value|%f|", ui->unmap->unmap(ui->unmap->handle, p->key), floatAtom->body);
-        } else if (p->value.type == ui->atom_String) {
-            LV2_Atom_String* stringAtom = (LV2_Atom_String*)&p->value;
-            sprintf(message + strlen(message), "key|%s|type|string|value|%s|", ui->unmap->unmap(ui->unmap->handle, p->key), ((char*)stringAtom) + sizeof(LV2_Atom_String));
-        } else if (p->value.type == ui->atom_Path) {
-            LV2_Atom_String* pathAtom = (LV2_Atom_String*)&p->value;
-            sprintf(message + strlen(message), "key|%s|type|path|value|%s|", ui->unmap->unmap(ui->unmap->handle, p->key), ((char*)pathAtom) + sizeof(LV2_Atom_String));
-        } else if (p->value.type == ui->atom_URID) {
-            LV2_Atom_URID* uridAtom = (LV2_Atom_URID*)&p->value;
-            sprintf(message + strlen(message), "key|%s|type|uri|value|%s|", ui->unmap->unmap(ui->unmap->handle, p->key), ui->unmap->unmap(ui->unmap->handle,uridAtom->body));
-        } else if (p->value.type == ui->atom_Object) {
-            an_object(ui, (LV2_Atom_Object*)p);
-        } else {
-            printf("\n Unsupported atom type %s  size %d ", ui->unmap->unmap(ui->unmap->handle, p->value.type),p->value.size);
-            fflush(stdout);
-            return;
+    printf("\nan_object %s", ui->unmap->unmap(ui->unmap->handle, obj->body.otype));fflush(stdout);
+
+    if (obj->body.otype == ui->patch_Set) {
+        const LV2_Atom_URID* property = NULL;
+        const LV2_Atom* value = NULL;
+        lv2_atom_object_get(obj, ui->patch_property, &property, ui->patch_value, &value, 0);
+        if (property && property->atom.type == ui->atom_URID && value) {
+            report_property(ui, property->body, value);
         }
+        return;
     }
-    printf("\nan_object:MESSAGE %s", message);fflush(stdout); 
-      if (ui->sockfd != -1) {
-         int status = send_message(ui->sockfd,message,strlen(message));
-         if (!status) ui->state = STATE_OPERATIONAL;
-      }
-
 
+    if (obj->body.otype == ui->patch_Put) {
+        const LV2_Atom_Object* body = NULL;
+        lv2_atom_object_get(obj, ui->patch_body, &body, 0);
+        if (body && (body->atom.type == ui->atom_Object || body->atom.type == ui->atom_Blank)) {
+            LV2_ATOM_OBJECT_FOREACH(body, p)
+            {
+                report_property(ui, p->key, &p->value);
+            }
+        }
+        return;
+    }
 }
 
 static void port_event(LV2UI_Handle handle, uint32_t port_index, uint32_t buffer_size, uint32_t format,
@@ -418,7 +663,14 @@ static void port_event(LV2UI_Handle handle, uint32_t port_index, uint32_t buffer
 {
     ThisUI* ui = (ThisUI*)handle;
     printf("\nPort event port %d format %d",port_index, format);fflush(stdout);
-    if(!format) return;
+    if(!format) {
+        if (buffer_size == sizeof(float) && port_index < NMB_PORT) {
+            ui->control_input_cache[port_index].value = *(const float*)buffer;
+            ui->control_input_cache[port_index].valid = true;
+            report_control(ui, port_index, NULL);
+        }
+        return;
+    }
 
     if (format != ui->atom_eventTransfer) {
         fprintf(stdout, "\nThisUI: Unexpected (not event transfer) message format %d  %s.\n",format,ui->unmap->unmap(ui->unmap->handle,format));
@@ -467,13 +719,65 @@ int split_on_delim(char *str, char *delim, char *parts[], int max_parts) {
     return count; // return the number of parts found
 }
 
+static int handle_command(ThisUI* ui, const char *msg_id, const char *msg_cmd, const char *msg_type, const char *msg_key, const char *msg_kind, const char *msg_value);
+
+/* Apply the set commands of a batch message, a JSON array of {type,key,kind,value} */
+static int handle_batch(ThisUI* ui, const char *items)
+{
+    json_error_t error;
+    json_t* array = items ? json_loads(items, 0, &error) : NULL;
+    if (!array || !json_is_array(array)) {
+        printf("\nInvalid batch items");fflush(stdout);
+        json_decref(array);
+        return 0;
+    }
+    size_t index;
+    json_t* item;
+    json_array_foreach(array, index, item) {
+        handle_command(ui, NULL, "set",
+            json_string_value(json_object_get(item, "type")),
+            json_string_value(json_object_get(item, "key")),
+            json_string_value(json_object_get(item, "kind")),
+            json_string_value(json_object_get(item, "value")));
+    }
+    json_decref(array);
+    return 0;
+}
+
 static int handle_server_message(char *message, ThisUI* ui) {
 
     printf("\nMessage with %d bytes received  %s", strlen(message), message);fflush(stdout);
 
+    if (message[0] == '{') {
+        json_error_t error;
+        json_t* root = json_loads(message, 0, &error);
+        if (!root || !json_is_object(root)) {
+            printf("\nInvalid JSON message: %s", error.text);fflush(stdout);
+            json_decref(root);
+            return 0;
+        }
+        const char* cmd = json_string_value(json_object_get(root, "cmd"));
+        if (cmd && !strcmp(cmd, "batch")) {
+            int status = handle_batch(ui, json_string_value(json_object_get(root, "items")));
+            json_decref(root);
+            return status;
+        }
+        int status = handle_command(ui,
+            json_string_value(json_object_get(root, "id")),
+            json_string_value(json_object_get(root, "cmd")),
+            json_string_value(json_object_get(root, "type")),
+            json_string_value(json_object_get(root, "key")),
+            json_string_value(json_object_get(root, "kind")),
+            json_string_value(json_object_get(root, "value")));
+        json_decref(root);
+        return status;
+    }
+
+    char *msg_id = NULL;
     char *msg_cmd = NULL;
     char *msg_type = NULL;
     char *msg_key = NULL;
+    char *msg_kind = NULL;
     char *msg_value = NULL;
 
     char *props[15];
@@ -483,27 +787,104 @@ static int handle_server_message(char *message, ThisUI* ui) {
         char *parts[2]; 
         int num_parts = split_on_delim(props[i], "|", parts, 2);
         if (num_parts == 2) {
-          if (!strcmp(parts[0], "cmd")) {
+          if (!strcmp(parts[0], "id")) {
+             msg_id = parts[1];
+          } else if (!strcmp(parts[0], "cmd")) {
              msg_cmd = parts[1];
           } else if (!strcmp(parts[0], "type")) {
              msg_type = parts[1];
           } else if (!strcmp(parts[0], "key")) {
              msg_key = parts[1];
+          } else if (!strcmp(parts[0], "kind")) {
+             msg_kind = parts[1];
           } else if (!strcmp(parts[0], "value")) {
              msg_value = parts[1];
           }
         }
     }
 
-    printf("\nCmd %s %s  %s   %s", msg_cmd, msg_type, msg_key, msg_value);
+    return handle_command(ui, msg_id, msg_cmd, msg_type, msg_key, msg_kind, msg_value);
+}
+
+/* Forge a patch value of the kind named by the server. Without a kind the value is sent as a string.
+   Returns 0 if the value did not fit in the forge buffer. */
+static LV2_Atom_Forge_Ref forge_value(ThisUI* ui, LV2_Atom_Forge* forge, const char* kind, const char* value)
+{
+    if (!kind || !strcmp(kind, "string")) {
+        return lv2_atom_forge_string(forge, value, strlen(value));
+    } else if (!strcmp(kind, "float")) {
+        return lv2_atom_forge_float(forge, (float)atof(value));
+    } else if (!strcmp(kind, "double")) {
+        return lv2_atom_forge_double(forge, atof(value));
+    } else if (!strcmp(kind, "int")) {
+        return lv2_atom_forge_int(forge, atoi(value));
+    } else if (!strcmp(kind, "long")) {
+        return lv2_atom_forge_long(forge, atoll(value));
+    } else if (!strcmp(kind, "bool")) {
+        return lv2_atom_forge_bool(forge, !strcmp(value, "true") || atoi(value) != 0);
+    } else if (!strcmp(kind, "path")) {
+        return lv2_atom_forge_path(forge, value, strlen(value));
+    } else if (!strcmp(kind, "uri")) {
+        return lv2_atom_forge_uri(forge, value, strlen(value));
+    } else if (!strcmp(kind, "urid")) {
+        return lv2_atom_forge_urid(forge, ui->map->map(ui->map->handle, value));
+    } else {
+        printf("\nUnknown value kind %s, sending as string", kind);fflush(stdout);
+        return lv2_atom_forge_string(forge, value, strlen(value));
+    }
+}
+
+static int handle_command(ThisUI* ui, const char *msg_id, const char *msg_cmd, const char *msg_type, const char *msg_key, const char *msg_kind, const char *msg_value) {
+
+    printf("\nCmd %s %s %s  %s   %s", msg_id, msg_cmd, msg_type, msg_key, msg_value);
     fflush(stdout);
 
 
+    if (!msg_cmd || !msg_type || !msg_key) {
+        printf("\nIncomplete message");fflush(stdout);
+        return 0;
+    }
+
     if (!strcmp(msg_cmd,"get")) {
         printf("\nReceived get command for type %s  key %s", msg_type, msg_key);fflush(stdout);
+        if (!strcmp(msg_type,"control")) {
+           int port_index = atoi(msg_key);
+           if (port_index >= 0 && port_index < NMB_PORT && ui->control_input_cache[port_index].valid) {
+              report_control(ui, port_index, msg_id);
+           } else {
+              report_error(ui, msg_id, "No value for control port");
+           }
+        } else if (!strcmp(msg_type,"midicc")) {
+           int cc = atoi(msg_key);
+           if (cc >= 0 && cc < NMB_MIDICC && ui->midicc_cache[cc].valid) {
+              report_midicc(ui, cc, msg_id);
+           } else {
+              report_error(ui, msg_id, "No value for MIDI CC");
+           }
+        } else if (!strcmp(msg_type,"patch") && ui->patch_input_port >= 0) {
+           LV2_URID property = ui->map->map(ui->map->handle, msg_key);
+           add_pending_get(ui, property, msg_id);
+           request_patch_get(ui, property);
+        } else {
+           report_error(ui, msg_id, "Unsupported parameter type");
+        }
+        return 0;
+    }
+
+    if (!msg_value) {
+        printf("\nMissing value for set command");fflush(stdout);
         return 0;
     }
 
+    if (!strcmp(msg_cmd,"touch")) {
+       /* Gesture markers, ui:touch only covers ports */
+       if (!strcmp(msg_type,"control") && ui->touch) {
+          int port_index = atoi(msg_key);
+          ui->touch->touch(ui->touch->handle, port_index, atoi(msg_value) != 0);
+       }
+       return 0;
+    }
+
     if (strcmp(msg_cmd,"set")) {
         printf("\nReceived unknown command %s", msg_cmd);fflush(stdout);
         return 0;
@@ -513,31 +894,46 @@ static int handle_server_message(char *message, ThisUI* ui) {
        printf("\nReceived set control  %s  %s", msg_key, msg_value);fflush(stdout);
        float value = atof(msg_value);
        int port_index = atoi(msg_key);
-       if (port_index < NMB_PORT) {
+       ui->write(ui->controller, port_index, sizeof(float), /*ui->ui_floatProtocol*/ 0, &value);
+       if (port_index >= 0 && port_index < NMB_PORT) {
           ui->control_input_cache[port_index].value = value;
           ui->control_input_cache[port_index].valid = true;
+          report_control(ui, port_index, NULL);
        }
-       ui->write(ui->controller, port_index, sizeof(float), /*ui->ui_floatProtocol*/ 0, &value);
        return 0;
     }
 
     if (!strcmp(msg_type,"patch") && ui->patch_input_port >= 0) {
        LV2_Atom_Forge forge;
-       uint8_t buffer[1000];
        LV2_Atom_Forge_Frame frame;
 
+       /* Room for the patch:Set object around the value, strings and paths are as long as the
+          value text plus terminator, other kinds need less. */
+       size_t size = 128 + lv2_atom_pad_size(strlen(msg_value) + 1);
+       uint8_t* buffer = malloc(size);
+       if (!buffer) {
+          report_error(ui, msg_id, "Out of memory");
+          return 0;
+       }
+
        LV2_URID parameter_key = ui->map->map(ui->map->handle, msg_key);
        lv2_atom_forge_init(&forge, ui->map);
 
-       lv2_atom_forge_set_buffer(&forge, buffer, sizeof(buffer));
+       lv2_atom_forge_set_buffer(&forge, buffer, size);
        lv2_atom_forge_object(&forge, &frame, 0, ui->patch_Set);
        lv2_atom_forge_key(&forge, ui->patch_property);
        lv2_atom_forge_urid(&forge, parameter_key);
        lv2_atom_forge_key(&forge, ui->patch_value);
-       lv2_atom_forge_string(&forge, msg_value, strlen(msg_value));
+       if (!forge_value(ui, &forge, msg_kind, msg_value)) {
+          printf("\nValue for %s too large, %zu bytes", msg_key, strlen(msg_value));fflush(stdout);
+          report_error(ui, msg_id, "Value too large");
+          free(buffer);
+          return 0;
+       }
        lv2_atom_forge_pop(&forge, &frame);
 
        ui->write(ui->controller, ui->patch_input_port, ((LV2_Atom*)buffer)->size + sizeof(LV2_Atom), ui->atom_eventTransfer, buffer);
+       free(buffer);
        return 0;
     }
 
@@ -608,6 +1004,7 @@ static int handle_server_message(char *message, ThisUI* ui) {
        printf("\n%02x %02x %02x %02x %02x %02x %02x %02x %02x %02x %02x %02x %02x %02x %02x %02x %02x %02x %02x %02x",
          buffer[0],buffer[1],buffer[2],buffer[3],buffer[4],buffer[5],buffer[6],buffer[7],buffer[8],buffer[9],buffer[10],buffer[11],buffer[12],buffer[13],buffer[14],buffer[15],buffer[16],buffer[17],buffer[18],buffer[19]);fflush(stdout);
        ui->write(ui->controller, ui->midi_input_port, lv2_atom_total_size((LV2_Atom*)buffer), ui->atom_eventTransfer, buffer);
+       report_midicc(ui, cc, NULL);
 
        return 0;
     }
@@ -712,13 +1109,23 @@ static int ui_idle(LV2UI_Handle handle)
           //return -1;
        }
 
-         char message[200];
-         sprintf(message,"source|%s||plugin|%s",ui->uid,ui->plugin_uri);
+         char message[600];
+         snprintf(message, sizeof(message), "source|%s||plugin|%s||protocol|%d||host|%s||instance|%s||ordinal|%d",
+             ui->uid, ui->plugin_uri, PROTOCOL_VERSION, ui->host, ui->instance, ui->ordinal);
          printf("\nMESSAGE %s", message);fflush(stdout); 
          int status = send_message(ui->sockfd, message, strlen(message));
          if (!status) {
             ui->state = STATE_OPERATIONAL;
             printf("\nConnection with server established.");fflush(stdout);
+
+            // Bring the server state cache up to date
+            for (int i = 0; i < NMB_PORT; i++) {
+              if (ui->control_input_cache[i].valid) report_control(ui, i, NULL);
+            }
+            for (int i = 0; i < NMB_MIDICC; i++) {
+              if (ui->midicc_cache[i].valid) report_midicc(ui, i, NULL);
+            }
+            request_patch_get(ui, 0);
          }
     }
 
@@ -732,12 +1139,12 @@ static int ui_idle(LV2UI_Handle handle)
 
     int ret = select(ui->sockfd + 1, &rfds, NULL, NULL, &tv);
     if (ret > 0 && FD_ISSET(ui->sockfd, &rfds)) {
-        char buf[BUFFER_SIZE];
-        int len = recv_frame(ui->sockfd, buf, sizeof(buf) - 1);
+        char* buf;
+        int len = recv_frame(ui->sockfd, &buf);
         if (len > 0) {
-            buf[len] = '\0';
             handle_server_message(buf, ui);
         }
+        free(buf);
     }
 
     if (FD_ISSET(ui->sockfd, &rfds)) {
@@ -0,0 +1,360 @@
+// =====================================================================================================
+// File:           aliases.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Stable context aliases for plugin instances across UI sessions
+// =====================================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+// Identity hints sent by a UI in its handshake
+type Identity struct {
+	Host     string `json:"host"`
+	Instance string `json:"instance,omitempty"` // Window title given by the host, e.g. the track name
+	Plugin   string `json:"plugin"`
+	Ordinal  int    `json:"ordinal"` // Instances of the same plugin opened before this one
+}
+
+type Alias struct {
+	Alias    string    `json:"alias"`
+	Identity Identity  `json:"identity"`
+	Restore  string    `json:"restore,omitempty"` // Restore policy, restorePolicy if empty
+	Shared   bool      `json:"shared,omitempty"`  // Instance label also used by another instance, keyed by ordinal too
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+var (
+	errNoSuchAlias  = errors.New("no such alias")
+	errAliasTaken   = errors.New("alias already in use")
+	errBadAliasName = errors.New("alias may only contain letters, digits, '-', '_' and '.'")
+)
+
+var aliasName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// =====================================================================================================
+// Local state
+// =====================================================================================================
+
+var (
+	aliases = make(map[string]*Alias) // By identity key
+	aliasMu sync.Mutex
+)
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+func identityHints(message Message) Identity {
+	ordinal, _ := strconv.Atoi(message["ordinal"])
+	return Identity{Host: message["host"], Instance: message["instance"], Plugin: message["plugin"], Ordinal: ordinal}
+}
+
+// Key an identity is remembered by. An instance label identifies the
+// instance on its own, without one the plugin ordinal has to. Instances
+// sharing a label are told apart by the ordinal as well.
+func (id Identity) key(shared bool) string {
+	if id.Instance == "" {
+		return id.Host + "\x00" + id.Plugin + "\x00" + strconv.Itoa(id.Ordinal)
+	}
+	if shared {
+		return id.Host + "\x00" + id.Instance + "\x00" + id.Plugin + "\x00" + strconv.Itoa(id.Ordinal)
+	}
+	return id.Host + "\x00" + id.Instance + "\x00" + id.Plugin
+}
+
+// Lower case name with runs of other characters than letters and digits
+// replaced by '-', e.g. "Bass Synth" -> "bass-synth".
+func slug(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// Must be called holding aliasMu.
+func aliasInUse(name string) bool {
+	for _, alias := range aliases {
+		if alias.Alias == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a connected UI of another instance than the one with the given
+// ordinal answers to an alias. A UI with the same ordinal is one being
+// replaced by its reconnecting instance.
+func aliasConnected(name string, ordinal int) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, conn := range connections {
+		if conn.Alias == name && conn.Ordinal != ordinal {
+			return true
+		}
+	}
+	return false
+}
+
+// Must be called holding aliasMu.
+func saveAliases() {
+	list := make([]*Alias, 0, len(aliases))
+	for _, alias := range aliases {
+		list = append(list, alias)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Alias < list[j].Alias })
+	persist("aliases", list)
+}
+
+func loadAliases() {
+	var list []*Alias
+	if err := LoadDocument("aliases", &list); err != nil {
+		log.Println("Loading aliases failed:", err)
+		return
+	}
+	aliasMu.Lock()
+	for _, alias := range list {
+		aliases[alias.Identity.key(alias.Shared)] = alias
+	}
+	aliasMu.Unlock()
+}
+
+// AssignAlias returns the alias of an instance, creating one the first time
+// it is seen. UIs sending no identity hints get no alias. An instance whose
+// label is taken by another connected instance gets an alias of its own.
+func AssignAlias(id Identity) string {
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	return assignAlias(id)
+}
+
+// Register a connection under the alias of its instance. Registering under
+// aliasMu keeps two instances connecting at once from both claiming an alias.
+func registerWithAlias(conn *UIConnection, id Identity) {
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	conn.Alias = assignAlias(id)
+	registerConnection(conn)
+}
+
+// Must be called holding aliasMu.
+func assignAlias(id Identity) string {
+	if id.Host == "" && id.Instance == "" {
+		return ""
+	}
+	now := time.Now()
+	key := id.key(false)
+	alias, ok := aliases[key]
+	shared := false
+	if ok && id.Instance != "" {
+		// An instance that got an alias of its own before keeps it
+		if own, found := aliases[id.key(true)]; found {
+			key, alias, shared = id.key(true), own, true
+		} else if aliasConnected(alias.Alias, id.Ordinal) {
+			key, ok, shared = id.key(true), false, true
+		}
+	}
+	if ok {
+		alias.LastSeen = now
+		saveAliases()
+		return alias.Alias
+	}
+
+	base := slug(id.Instance)
+	if base == "" {
+		base = slug(pluginName(id.Plugin))
+		if id.Ordinal > 0 {
+			base = fmt.Sprintf("%s-%d", base, id.Ordinal+1)
+		}
+	}
+	if base == "" {
+		base = "instance"
+	}
+	name := base
+	for n := 2; aliasInUse(name); n++ {
+		name = fmt.Sprintf("%s-%d", base, n)
+	}
+	aliases[key] = &Alias{Alias: name, Identity: id, Shared: shared, Created: now, LastSeen: now}
+	saveAliases()
+	return name
+}
+
+func ListAliases() []Alias {
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	result := make([]Alias, 0, len(aliases))
+	for _, alias := range aliases {
+		result = append(result, *alias)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Alias < result[j].Alias })
+	return result
+}
+
+// Give an alias a new name. A connected instance answers to it at once.
+func RenameAlias(old string, name string) error {
+	if !aliasName.MatchString(name) {
+		return errBadAliasName
+	}
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	var found *Alias
+	for _, alias := range aliases {
+		if alias.Alias == old {
+			found = alias
+		}
+	}
+	if found == nil {
+		return errNoSuchAlias
+	}
+	if name == old {
+		return nil
+	}
+	if aliasInUse(name) {
+		return errAliasTaken
+	}
+	found.Alias = name
+	saveAliases()
+
+	mu.Lock()
+	for _, conn := range connections {
+		if conn.Alias == old {
+			conn.Alias = name
+		}
+	}
+	mu.Unlock()
+
+	renameLastState(old, name)
+	renameFeed(old, name)
+	renameSnapshots(old, name)
+	renameInstanceDocuments(old, name)
+	return nil
+}
+
+// Key for state kept per plugin instance: the alias of the connection if it
+// has one, otherwise the context itself.
+func contextKey(context string) (string, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if conn, ok := connections[context]; ok && conn.Alias != "" {
+		return conn.Alias, true
+	}
+	return context, false
+}
+
+// ResolveContext maps an alias to the id of the connection currently
+// serving it. Connection ids and unknown names are returned unchanged.
+func ResolveContext(context string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := connections[context]; ok {
+		return context
+	}
+	var latest *UIConnection
+	for _, conn := range connections {
+		if conn.Alias == context && (latest == nil || conn.Connected.After(latest.Connected)) {
+			latest = conn
+		}
+	}
+	if latest == nil {
+		return context
+	}
+	return latest.Id
+}
+
+// Let every handler taking a context query parameter accept aliases.
+func resolveAliases(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if context := query.Get("context"); context != "" {
+			if id := ResolveContext(context); id != context {
+				query.Set("context", id)
+				r.URL.RawQuery = query.Encode()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func aliasErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNoSuchAlias):
+		return 404
+	case errors.Is(err, errAliasTaken):
+		return 409
+	case errors.Is(err, errBadAliasName):
+		return 400
+	}
+	return 500
+}
+
+// =====================================================================================================
+// aliasesHandler
+// =====================================================================================================
+func aliasesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ListAliases())
+}
+
+// =====================================================================================================
+// aliasRenameHandler
+// =====================================================================================================
+func aliasRenameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	alias := r.URL.Query().Get("alias")
+	name := r.URL.Query().Get("name")
+	if alias == "" || name == "" {
+		http.Error(w, "Missing 'alias' or 'name' parameter", 400)
+		return
+	}
+	if err := RenameAlias(alias, name); err != nil {
+		http.Error(w, err.Error(), aliasErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	http.HandleFunc("/aliases", aliasesHandler)
+	http.HandleFunc("/aliases/rename", aliasRenameHandler)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlug(t *testing.T) {
+	cases := map[string]string{
+		"Bass Synth":        "bass-synth",
+		"  Lead -- Vox! ":   "lead-vox",
+		"Track 12 / Reverb": "track-12-reverb",
+		"ÄÖ":                "",
+		"":                  "",
+	}
+	for in, want := range cases {
+		if got := slug(in); got != want {
+			t.Errorf("slug(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestAssignAlias(t *testing.T) {
+	if alias := AssignAlias(Identity{Plugin: "urn:test:synth"}); alias != "" {
+		t.Errorf("a UI without hints should get no alias, got %q", alias)
+	}
+
+	bass := Identity{Host: "alias-host-a", Instance: "Bass", Plugin: "urn:test:synth"}
+	first := AssignAlias(bass)
+	if first != "bass" {
+		t.Fatalf("expected alias bass, got %q", first)
+	}
+	if again := AssignAlias(bass); again != first {
+		t.Errorf("the same instance should keep its alias, got %q", again)
+	}
+
+	// The same label on another host collides and is numbered
+	other := AssignAlias(Identity{Host: "alias-host-b", Instance: "Bass", Plugin: "urn:test:synth"})
+	third := AssignAlias(Identity{Host: "alias-host-c", Instance: "Bass", Plugin: "urn:test:synth"})
+	if other != "bass-2" || third != "bass-3" {
+		t.Errorf("expected bass-2 and bass-3, got %q and %q", other, third)
+	}
+}
+
+func TestAssignAliasByOrdinal(t *testing.T) {
+	base := slug(pluginName("urn:test:ordinal"))
+	first := AssignAlias(Identity{Host: "alias-host-d", Plugin: "urn:test:ordinal", Ordinal: 0})
+	second := AssignAlias(Identity{Host: "alias-host-d", Plugin: "urn:test:ordinal", Ordinal: 1})
+	if first != base || second != base+"-2" {
+		t.Errorf("expected %s and %s-2, got %q and %q", base, base, first, second)
+	}
+	// A reopened UI given its ordinal back keeps the alias
+	if again := AssignAlias(Identity{Host: "alias-host-d", Plugin: "urn:test:ordinal", Ordinal: 1}); again != second {
+		t.Errorf("expected %q again, got %q", second, again)
+	}
+}
+
+func TestStreamFollowsAlias(t *testing.T) {
+	alias := AssignAlias(Identity{Host: "alias-host-e", Instance: "Stream Test", Plugin: "urn:test"})
+	before := connectTestUI(t, "alias-stream-1", ProtocolJSON, testInfo())
+	mu.Lock()
+	before.conn.Alias = alias
+	mu.Unlock()
+
+	events, unsubscribe := Subscribe(ResolveContext(alias))
+	defer unsubscribe()
+
+	// The UI comes back under a new connection id
+	after := connectTestUI(t, "alias-stream-2", ProtocolJSON, testInfo())
+	mu.Lock()
+	after.conn.Alias = alias
+	mu.Unlock()
+	if id := ResolveContext(alias); id != "alias-stream-2" {
+		t.Fatalf("alias should resolve to the new connection, got %q", id)
+	}
+	handleUIMessage(after.conn, Message{"type": "control", "key": "1", "value": "0.5"})
+
+	select {
+	case event := <-events:
+		if event.Context != "alias-stream-2" || event.Key != "1" || event.Value != "0.5" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event from the reconnected UI")
+	}
+}
+
+func TestAssignAliasSharedLabel(t *testing.T) {
+	connect := func(id string, identity Identity) *testUI {
+		ui := connectTestUI(t, id, ProtocolJSON, testInfo())
+		alias := AssignAlias(identity)
+		mu.Lock()
+		ui.conn.Alias = alias
+		ui.conn.Ordinal = identity.Ordinal
+		mu.Unlock()
+		return ui
+	}
+	lead := Identity{Host: "alias-host-f", Instance: "Lead", Plugin: "urn:test"}
+	second := lead
+	second.Ordinal = 1
+
+	first := connect("shared-1", lead)
+	if first.conn.Alias != "lead" {
+		t.Fatalf("expected alias lead, got %q", first.conn.Alias)
+	}
+	// Another live instance with the same label gets an alias of its own
+	if alias := AssignAlias(second); alias != "lead-2" {
+		t.Errorf("expected lead-2 for the second instance, got %q", alias)
+	}
+	if alias := AssignAlias(second); alias != "lead-2" {
+		t.Errorf("the second instance should keep lead-2, got %q", alias)
+	}
+	// The first instance reconnecting before its old UI is gone keeps its alias
+	if alias := AssignAlias(lead); alias != "lead" {
+		t.Errorf("a reconnecting instance should keep lead, got %q", alias)
+	}
+	unregisterConnection(first.conn)
+	if alias := AssignAlias(second); alias != "lead-2" {
+		t.Errorf("the second instance should keep lead-2 after the first closed, got %q", alias)
+	}
+}
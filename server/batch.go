@@ -0,0 +1,183 @@
+// =====================================================================================================
+// File:           batch.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Web server service handler setting several parameters in one request
+// =====================================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+// Largest accepted batch request body
+const maxBatchBody = 1 << 20
+
+type BatchResult struct {
+	Setting
+	Ok    bool             `json:"ok"`
+	Error *ValidationError `json:"error,omitempty"`
+}
+
+// One set command inside a batch message
+type batchItem struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Kind  string `json:"kind,omitempty"`
+	Value string `json:"value"`
+}
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+// SetParameters validates the settings against the plugin metadata and
+// sends the valid ones to the UI as one batch message, which the UI applies
+// as a whole. UIs speaking protocol version 1 get one set command per
+// setting instead. The settings sent are recorded for undo as one step. The
+// settings are not modified, the results carry the values sent.
+func SetParameters(context string, settings []Setting) ([]BatchResult, error) {
+	results, changes, err := applyParameters(context, settings)
+	if err != nil {
+		return nil, err
+	}
+	RecordEdits(context, changes)
+	return results, nil
+}
+
+// Validate and send settings like SetParameters without journaling them.
+// Returns the changes made to parameters with a known previous value.
+func applyParameters(context string, settings []Setting) ([]BatchResult, []HistoryChange, error) {
+	mu.Lock()
+	conn, ok := connections[context]
+	mu.Unlock()
+	if !ok {
+		return nil, nil, ErrNoConnection
+	}
+
+	results := make([]BatchResult, len(settings))
+	old := make([]string, len(settings))
+	known := make([]bool, len(settings))
+	var items []batchItem
+	var valid []int
+	for i, setting := range settings {
+		results[i].Setting = setting
+		value, err := ValidateSetting(conn.Info, setting)
+		if err != nil {
+			if !errors.As(err, &results[i].Error) {
+				return nil, nil, err
+			}
+			continue
+		}
+		results[i].Value = value
+		old[i], known[i] = CurrentValue(context, setting.Type, setting.Key)
+		message := conn.setMessage(setting.Type, setting.Key, value)
+		items = append(items, batchItem{Type: message["type"], Key: message["key"], Kind: message["kind"], Value: message["value"]})
+		valid = append(valid, i)
+	}
+	if len(valid) == 0 {
+		return results, nil, nil
+	}
+	if err := conn.sendSettings(results, items, valid); err != nil {
+		return nil, nil, err
+	}
+	var changes []HistoryChange
+	for i, result := range results {
+		if result.Ok && known[i] {
+			changes = append(changes, HistoryChange{Type: result.Type, Key: result.Key, Old: old[i], New: result.Value})
+		}
+	}
+	return results, changes, nil
+}
+
+// Queue the valid settings of a batch, given by index into results, and
+// mark each result sent or failed. Fails if nothing could be queued, so a
+// full outbox is reported as such. A batch is queued whole or not at all.
+func (conn *UIConnection) sendSettings(results []BatchResult, items []batchItem, valid []int) error {
+	if conn.Protocol < ProtocolJSON {
+		for n, i := range valid {
+			sent := results[i].Setting
+			_, err := conn.queueSet(conn.setMessage(sent.Type, sent.Key, sent.Value))
+			if err != nil && n == 0 {
+				return err
+			}
+			results[i].setSent(err)
+		}
+		return nil
+	}
+
+	encoded, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.queueBatch(Message{"cmd": "batch", "items": string(encoded)}); err != nil {
+		return err
+	}
+	for _, i := range valid {
+		results[i].setSent(nil)
+	}
+	return nil
+}
+
+// Record whether the setting of a result could be queued.
+func (result *BatchResult) setSent(err error) {
+	if err != nil {
+		reason := ReasonNotSent
+		if errors.Is(err, ErrQueueFull) {
+			reason = ReasonQueueFull
+		}
+		result.Error = &ValidationError{Message: err.Error(), Reason: reason, Type: result.Type, Key: result.Key, Value: result.Value}
+		return
+	}
+	result.Ok = true
+}
+
+// =====================================================================================================
+// batchHandler
+// =====================================================================================================
+
+// POST /madigan-parameter/batch?context= with a JSON array of
+// {"type":..,"key":..,"value":..} and answers with the result per item.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	context := r.URL.Query().Get("context")
+	if context == "" {
+		http.Error(w, "No context specified", 400)
+		return
+	}
+	var settings []Setting
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(&settings); err != nil {
+		http.Error(w, "Invalid batch: "+err.Error(), 400)
+		return
+	}
+	results, err := SetParameters(context, settings)
+	if errors.Is(err, ErrNoConnection) {
+		http.Error(w, "No such connection", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), sendErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	http.HandleFunc("/madigan-parameter/batch", batchHandler)
+}
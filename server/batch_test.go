@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestSetSentReason(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason string
+	}{
+		{ErrQueueFull, ReasonQueueFull},
+		{ErrPeerGone, ReasonNotSent},
+		{fmt.Errorf("wrapped: %w", ErrQueueFull), ReasonQueueFull},
+	}
+	for _, test := range tests {
+		var result BatchResult
+		result.setSent(test.err)
+		if result.Ok || result.Error == nil || result.Error.Reason != test.reason {
+			t.Errorf("%v: got %+v, want reason %s", test.err, result, test.reason)
+		}
+	}
+	var result BatchResult
+	if result.setSent(nil); !result.Ok || result.Error != nil {
+		t.Errorf("sent setting should be ok, got %+v", result)
+	}
+}
+
+func TestSetParameters(t *testing.T) {
+	ui := connectTestUI(t, "batch-ui", ProtocolJSON, testInfo())
+	dropHistory("batch-ui")
+	settings := []Setting{
+		{Type: "control", Key: "1", Value: "7"},
+		{Type: "control", Key: "9", Value: "0.5"},
+		{Type: "patch", Key: "urn:test#cutoff", Value: "440"},
+		{Type: "control", Key: "1", Value: "loud"},
+	}
+	results, err := SetParameters("batch-ui", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !results[0].Ok || results[0].Value != "1" {
+		t.Errorf("out of range value should be clamped and sent, got %+v", results[0])
+	}
+	if results[1].Ok || results[1].Error == nil || results[1].Error.Reason != ReasonUnknownParameter {
+		t.Errorf("unknown port should fail, got %+v", results[1])
+	}
+	if !results[2].Ok {
+		t.Errorf("patch value should be sent, got %+v", results[2])
+	}
+	if results[3].Ok || results[3].Error == nil || results[3].Error.Reason != ReasonNotANumber {
+		t.Errorf("text for a control port should fail, got %+v", results[3])
+	}
+	if settings[0].Value != "7" {
+		t.Errorf("caller's settings were modified: %+v", settings[0])
+	}
+
+	m := ui.next(t)
+	if m["cmd"] != "batch" {
+		t.Fatalf("expected a batch, got %v", m)
+	}
+	var items []batchItem
+	if err := json.Unmarshal([]byte(m["items"]), &items); err != nil {
+		t.Fatal(err)
+	}
+	want := []batchItem{
+		{Type: "control", Key: "1", Value: "1"},
+		{Type: "patch", Key: "urn:test#cutoff", Kind: KindFloat, Value: "440"},
+	}
+	if len(items) != len(want) || items[0] != want[0] || items[1] != want[1] {
+		t.Fatalf("got items %+v, want %+v", items, want)
+	}
+
+	// The patch parameter never reported a value, only the control edit can be undone
+	if h := ListHistory("batch-ui"); len(h.Undo) != 1 || len(h.Undo[0].Changes) != 1 || h.Undo[0].Changes[0].Key != "1" || h.Undo[0].Changes[0].Old != "0.25" {
+		t.Errorf("expected the control edit in the history, got %+v", h.Undo)
+	}
+}
+
+func TestSetParametersLegacy(t *testing.T) {
+	ui := connectTestUI(t, "batch-legacy", ProtocolLegacy, testInfo())
+	results, err := SetParameters("batch-legacy", []Setting{
+		{Type: "control", Key: "1", Value: "0.5"},
+		{Type: "patch", Key: "urn:test#cutoff", Value: "880"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if !result.Ok {
+			t.Fatalf("expected all sent, got %+v", results)
+		}
+	}
+	if m := ui.next(t); m["cmd"] != "set" || m["key"] != "1" || m["value"] != "0.5" {
+		t.Fatalf("expected a set for port 1, got %v", m)
+	}
+	if m := ui.next(t); m["cmd"] != "set" || m["key"] != "urn:test#cutoff" || m["value"] != "880" {
+		t.Fatalf("expected a set for the patch parameter, got %v", m)
+	}
+}
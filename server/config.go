@@ -0,0 +1,185 @@
+// =====================================================================================================
+// File:           config.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Server settings taken from the environment
+// =====================================================================================================
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =====================================================================================================
+// Local state
+// =====================================================================================================
+
+var (
+	// How long a GET on /madigan-parameter waits for the plugin UI to answer
+	getTimeout = envDuration("MADIGAN_GET_TIMEOUT", 2*time.Second)
+
+	// Rescan LV2 bundles when the LV2_PATH directories change
+	watchLV2Path = envBool("MADIGAN_WATCH_LV2_PATH", false)
+
+	// Language for rdfs:label literals, overrides LANG for lilv
+	lv2Lang = os.Getenv("MADIGAN_LANG")
+
+	// Origins besides this server's own whose pages may open parameter sockets, "*" for any
+	allowedOrigins = envCSV("MADIGAN_ALLOWED_ORIGINS", nil)
+
+	// Directories the file browser and uploads are confined to
+	mediaDirs = envList("MADIGAN_MEDIA_DIRS", []string{filepath.Join(homeDir(), ".madigan", "media")})
+
+	// Largest file accepted by /files/upload, in bytes
+	uploadMaxSize = envInt("MADIGAN_UPLOAD_MAX_SIZE", 512<<20)
+
+	// Extensions or mod:fileTypes categories accepted by /files/upload
+	uploadTypes = envCSV("MADIGAN_UPLOAD_TYPES", []string{"audiosample", "ir", "sf2", "sfz", "midiclip", "nammodel", "h2drumkit"})
+
+	// Sample rate used for lv2:sampleRate ranges, the server does not know the host's
+	sampleRate = envFloat("MADIGAN_SAMPLE_RATE", 48000)
+
+	// Steps per second when morphing between snapshots, bounds the set commands sent per parameter
+	morphRate = envFloat("MADIGAN_MORPH_RATE", 25)
+
+	// Undo steps kept per connection
+	undoDepth = envInt("MADIGAN_UNDO_DEPTH", 100)
+
+	// Edits of the same parameter closer together than this are undone as one step
+	undoCoalesce = envDuration("MADIGAN_UNDO_COALESCE", 500*time.Millisecond)
+
+	// Set commands sent per second to each plugin UI, pending sets of a parameter are coalesced
+	setRate = envFloat("MADIGAN_SET_RATE", 50)
+
+	// Clamp set values outside a parameter's min/max, reject them otherwise
+	clampValues = envBool("MADIGAN_CLAMP_VALUES", true)
+
+	// Commands waiting in the rate limited outbox of each UI before sets fail
+	outboxLen = envInt("MADIGAN_OUTBOX_LEN", 256)
+
+	// Frames waiting to be written to each UI socket before sends fail
+	writeQueueLen = envInt("MADIGAN_WRITE_QUEUE", 64)
+
+	// Longest time a frame write to a UI socket may block
+	writeTimeout = envDuration("MADIGAN_WRITE_TIMEOUT", 5*time.Second)
+
+	// Directory for state kept across server restarts, such as context aliases
+	stateDir = envString("MADIGAN_STATE_DIR", filepath.Join(homeDir(), ".madigan"))
+
+	// Backend persisting server state, "json[:<dir>]" for JSON files (stateDir by default) or "memory"
+	storeSpec = envString("MADIGAN_STORE", "json")
+
+	// What to do with the last known state when an aliased instance reconnects: ignore, restore or ask
+	restorePolicy = envString("MADIGAN_RESTORE_POLICY", RestoreAsk)
+
+	// How long a reconnected instance may take to report its values before they are compared with its last known state
+	restoreSettle = envDuration("MADIGAN_RESTORE_SETTLE", 2*time.Second)
+)
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+func envString(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s=%q, using %v", name, value, def)
+		return def
+	}
+	return d
+}
+
+func envBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %v", name, value, def)
+		return def
+	}
+	return b
+}
+
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		log.Printf("Invalid %s=%q, using %v", name, value, def)
+		return def
+	}
+	return f
+}
+
+// Colon separated list of paths
+func envList(name string, def []string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	var result []string
+	for _, item := range filepath.SplitList(value) {
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func homeDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return home
+}
+
+func envInt(name string, def int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || i <= 0 {
+		log.Printf("Invalid %s=%q, using %v", name, value, def)
+		return def
+	}
+	return i
+}
+
+// Comma separated list of words
+func envCSV(name string, def []string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,160 @@
+// =====================================================================================================
+// File:           contexts.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Web server service handlers listing and inspecting the connected plugin UIs
+// =====================================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+type ContextInfo struct {
+	Id           string    `json:"id"`
+	Alias        string    `json:"alias,omitempty"`
+	Plugin       string    `json:"plugin"`
+	Name         string    `json:"name"`
+	Remote       string    `json:"remote"`
+	Protocol     int       `json:"protocol"`
+	Connected    time.Time `json:"connected"`
+	LastActivity time.Time `json:"lastActivity"`
+	Received     uint64    `json:"received"` // Frames read from the UI
+	Sent         uint64    `json:"sent"`     // Frames written to the UI
+	Queued       int       `json:"queued"`   // Frames waiting to be written
+}
+
+type StateEntry struct {
+	Type    string    `json:"type"`
+	Key     string    `json:"key"`
+	Kind    string    `json:"kind"`
+	Value   string    `json:"value"`
+	Updated time.Time `json:"updated"`
+}
+
+type ContextDetail struct {
+	ContextInfo
+	Info  AllInfo      `json:"info"`
+	State []StateEntry `json:"state"`
+}
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+func (conn *UIConnection) touch() {
+	conn.lastActivity.Store(time.Now().UnixNano())
+}
+
+// Name of an installed plugin, the URI if it is not known.
+func pluginName(uri string) string {
+	for _, entry := range PluginCatalogue() {
+		if entry.Uri == uri && entry.Name != "" {
+			return entry.Name
+		}
+	}
+	return uri
+}
+
+// Must be called holding mu.
+func (conn *UIConnection) contextInfo() ContextInfo {
+	return ContextInfo{
+		Id:           conn.Id,
+		Alias:        conn.Alias,
+		Plugin:       conn.Plugin,
+		Remote:       conn.Conn.RemoteAddr().String(),
+		Protocol:     conn.Protocol,
+		Connected:    conn.Connected,
+		LastActivity: time.Unix(0, conn.lastActivity.Load()),
+		Received:     conn.received.Load(),
+		Sent:         conn.sent.Load(),
+		Queued:       len(conn.writes),
+	}
+}
+
+// Connected plugin UIs, oldest connection first.
+func Contexts() []ContextInfo {
+	mu.Lock()
+	result := make([]ContextInfo, 0, len(connections))
+	for _, conn := range connections {
+		result = append(result, conn.contextInfo())
+	}
+	mu.Unlock()
+
+	for i := range result {
+		result[i].Name = pluginName(result[i].Plugin)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Connected.Before(result[j].Connected) })
+	return result
+}
+
+func ContextDetails(id string) (ContextDetail, bool) {
+	mu.Lock()
+	conn, ok := connections[id]
+	if !ok {
+		mu.Unlock()
+		return ContextDetail{}, false
+	}
+	detail := ContextDetail{ContextInfo: conn.contextInfo(), Info: conn.Info, State: make([]StateEntry, 0, len(conn.Reported))}
+	for key, value := range conn.Reported {
+		detail.State = append(detail.State, StateEntry{Type: key.Type, Key: key.Key, Kind: value.Kind, Value: value.String(), Updated: value.Updated})
+	}
+	mu.Unlock()
+
+	detail.Name = pluginName(detail.Plugin)
+	sort.Slice(detail.State, func(i, j int) bool {
+		if detail.State[i].Type != detail.State[j].Type {
+			return detail.State[i].Type < detail.State[j].Type
+		}
+		return detail.State[i].Key < detail.State[j].Key
+	})
+	return detail, true
+}
+
+// =====================================================================================================
+// contextsHandler
+// =====================================================================================================
+func contextsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Contexts())
+}
+
+// =====================================================================================================
+// contextHandler
+// =====================================================================================================
+func contextHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	detail, ok := ContextDetails(ResolveContext(r.PathValue("id")))
+	if !ok {
+		http.Error(w, "No such connection", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	http.HandleFunc("/contexts", contextsHandler)
+	http.HandleFunc("/contexts/{id}", contextHandler)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestContextsHandler(t *testing.T) {
+	first := connectTestUI(t, "contexts-first", ProtocolLegacy, testInfo())
+	second := connectTestUI(t, "contexts-second", ProtocolJSON, testInfo())
+	mu.Lock()
+	second.conn.Alias = "contexts-alias"
+	mu.Unlock()
+	second.report(map[string]string{"urn:test#cutoff": "440", "1": "0.5"})
+	if _, err := second.conn.Send(Message{"cmd": "get", "type": "control", "key": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	second.next(t)
+	// The writer counts the frame once the write has returned
+	deadline := time.Now().Add(2 * time.Second)
+	for second.conn.sent.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	contextsHandler(w, httptest.NewRequest(http.MethodGet, "/contexts", nil))
+	var contexts []ContextInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &contexts); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	var listed []ContextInfo
+	for _, context := range contexts {
+		if context.Id == first.conn.Id || context.Id == second.conn.Id {
+			listed = append(listed, context)
+		}
+	}
+	if len(listed) != 2 || listed[0].Id != "contexts-first" || listed[1].Id != "contexts-second" {
+		t.Fatalf("expected both connections, oldest first, got %+v", listed)
+	}
+	if c := listed[0]; c.Alias != "" || c.Protocol != ProtocolLegacy || c.Plugin != "urn:test" || c.Name != "urn:test" || c.Sent != 0 || c.Received != 0 {
+		t.Errorf("first connection: got %+v", c)
+	}
+	// Reports are handled directly in the test, only writes are counted
+	if c := listed[1]; c.Alias != "contexts-alias" || c.Protocol != ProtocolJSON || c.Sent != 1 || c.Queued != 0 || c.LastActivity.Before(c.Connected) {
+		t.Errorf("second connection: got %+v", c)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/contexts/contexts-alias", nil)
+	r.SetPathValue("id", "contexts-alias")
+	w = httptest.NewRecorder()
+	contextHandler(w, r)
+	var detail ContextDetail
+	if err := json.Unmarshal(w.Body.Bytes(), &detail); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("detail by alias: got %d %s", w.Code, w.Body)
+	}
+	if detail.Id != "contexts-second" || len(detail.Info.ControlInput) != 2 || len(detail.State) != 2 ||
+		detail.State[0].Type != "control" || detail.State[0].Value != "0.5" || detail.State[1].Key != "urn:test#cutoff" || detail.State[1].Value != "440" {
+		t.Errorf("detail: got %+v", detail)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/contexts/contexts-none", nil)
+	r.SetPathValue("id", "contexts-none")
+	w = httptest.NewRecorder()
+	contextHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown context: got %d", w.Code)
+	}
+}
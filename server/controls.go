@@ -38,7 +38,11 @@ type View struct {
         Element       string   `json:"element"`
         Min           *float32 `json:"min,omitempty"`
         Max           *float32 `json:"max,omitempty"`
+        Step          *float32 `json:"step,omitempty"`
         Integer       bool     `json:"integer,omitempty"`
+        Logarithmic   bool     `json:"logarithmic,omitempty"`
+        Expensive     bool     `json:"expensive,omitempty"`
+        Unit          string   `json:"unit,omitempty"`
         Points        []Point  `json:"points,omitempty"`
 }
 
@@ -142,6 +146,34 @@ func getNode(nodeID int) (interface{},interface{},interface{}, error) {
 	return nil, nil, nil, fmt.Errorf("No node data found") 
 }
 */
+// Slider view for a numeric port or parameter
+func sliderView(info Info) View {
+        min, max := info.Min, info.Max
+        if info.SampleRate {
+          min *= float32(sampleRate)
+          max *= float32(sampleRate)
+        }
+        view := View{Element: "madigan-slider", Min: &min, Max: &max, Integer: info.Integer, Logarithmic: info.Logarithmic}
+        if info.RangeSteps > 1 {
+          step := (max - min) / float32(info.RangeSteps - 1)
+          view.Step = &step
+        }
+        return view
+}
+
+// Select view for an enumeration or toggle
+func selectView(info Info) View {
+        return View{Element: "madigan-select", Points: info.Scale}
+}
+
+// Control label with the unit appended, e.g. "Gain (dB)"
+func controlName(info Info) string {
+        if info.Unit == "" {
+          return info.Name
+        }
+        return fmt.Sprintf("%s (%s)", info.Name, info.Unit)
+}
+
 // =====================================================================================================
 // controlsHandler
 // =====================================================================================================
@@ -160,50 +192,71 @@ func controlsHandler(w http.ResponseWriter, r *http.Request) {
 
         for _, port := range all.ControlInput {
 	    log.Printf("Port: %v", port)
-            if port.Input && port.Control {
+            if port.Input && port.Control && !port.NotOnGUI {
                 endpoint := Endpoint{Element: "madigan-parameter", Type: "control", Key: port.Index}
                 view := View{}
-                if port.Enum || port.Toggle {
-                  view.Element ="madigan-select"
-                  view.Points = port.Scale
-                } else {
-                  view.Element ="madigan-slider"
-                  view.Min = &port.Min
+                if port.Trigger {
+                  view.Element ="madigan-button"
                   view.Max = &port.Max
-                  view.Integer = true
+                } else if port.Enum || port.Toggle {
+                  view = selectView(port)
+                } else {
+                  view = sliderView(port)
                 }
-                control := Control{Endpoint: endpoint, View: view, Name: port.Name }
+                view.Unit = port.Unit
+                view.Expensive = port.Expensive
+                control := Control{Endpoint: endpoint, View: view, Name: controlName(port) }
                 controls = append(controls, control)
            }
         }
 
         for _, midi := range all.MidiParameter {
+            if midi.NotOnGUI {
+              continue
+            }
             endpoint := Endpoint{Element: "madigan-parameter", Type: "midicc", Key: midi.Midicc}
             view := View{}
             if (midi.Enum || midi.Toggle) {
-              view.Element ="madigan-select"
-              view.Points = midi.Scale
+              view = selectView(midi)
             } else {
-              view.Element ="madigan-slider"
-              view.Min = &midi.Min
-              view.Max = &midi.Max
+              view = sliderView(midi)
               view.Integer = true
             }
-            control := Control{Endpoint: endpoint, View: view, Name: midi.Name }
+            view.Unit = midi.Unit
+            control := Control{Endpoint: endpoint, View: view, Name: controlName(midi) }
             controls = append(controls, control)
         }
 
         for _, param := range all.PatchParameter {
 	    log.Printf("Param: %v", param)
+            if param.NotOnGUI {
+              continue
+            }
             endpoint := Endpoint{Element: "madigan-parameter", Type: "patch", Key: param.Uri}
             view := View{}
-            if param.Range == "http://lv2plug.in/ns/ext/atom#Path" {
+            kind := RangeKind(param.Range)
+            if kind == KindPath {
               view.Element ="madigan-filepath"
+            } else if param.Enum || param.Toggle || len(param.Scale) > 0 {
+              view = selectView(param)
             } else {
-              view.Element ="madigan-select"
-              view.Points = []Point{Point{Label: "TBD", Value: 0},Point{Label: "TBD", Value: 100}}
+              switch kind {
+                case KindFloat, KindDouble:
+                  view = sliderView(param)
+                case KindInt, KindLong:
+                  view = sliderView(param)
+                  view.Integer = true
+                case KindBool:
+                  view.Element ="madigan-checkbox"
+                case KindUri, KindUrid:
+                  view.Element ="madigan-uri"
+                default:
+                  view.Element ="madigan-text"
+              }
             }
-            control := Control{Endpoint: endpoint, View: view, Name: param.Name }
+            view.Unit = param.Unit
+            view.Expensive = param.Expensive
+            control := Control{Endpoint: endpoint, View: view, Name: controlName(param) }
             controls = append(controls, control)
         }
 
@@ -0,0 +1,153 @@
+// =====================================================================================================
+// File:           documents.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Web server service handler storing browser owned settings per plugin instance
+// =====================================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+// Largest accepted document body
+const maxDocumentBody = 1 << 20
+
+// Documents whose content is defined by the browser UI. The server keeps
+// one JSON value per plugin instance in each, without interpreting it.
+var clientDocuments = map[string]bool{
+	"midi-mappings": true,
+	"layouts":       true,
+}
+
+// =====================================================================================================
+// Local state
+// =====================================================================================================
+
+var documentsMu sync.Mutex
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+// Value stored for a plugin instance in a client document, nil if none.
+func GetInstanceDocument(name string, context string) (json.RawMessage, error) {
+	key, _ := contextKey(context)
+	documentsMu.Lock()
+	defer documentsMu.Unlock()
+	var values map[string]json.RawMessage
+	if err := LoadDocument(name, &values); err != nil {
+		return nil, err
+	}
+	return values[key], nil
+}
+
+// Store the value for a plugin instance in a client document, a nil value removes it.
+func PutInstanceDocument(name string, context string, value json.RawMessage) error {
+	key, _ := contextKey(context)
+	documentsMu.Lock()
+	defer documentsMu.Unlock()
+	values := make(map[string]json.RawMessage)
+	if err := LoadDocument(name, &values); err != nil {
+		return err
+	}
+	if value == nil {
+		delete(values, key)
+	} else {
+		values[key] = value
+	}
+	return SaveDocument(name, values)
+}
+
+// Move the values of a renamed alias in all client documents.
+func renameInstanceDocuments(old string, name string) {
+	documentsMu.Lock()
+	defer documentsMu.Unlock()
+	for document := range clientDocuments {
+		var values map[string]json.RawMessage
+		if err := LoadDocument(document, &values); err != nil {
+			log.Printf("Loading %s failed: %v", document, err)
+			continue
+		}
+		if value, ok := values[old]; ok {
+			values[name] = value
+			delete(values, old)
+			persist(document, values)
+		}
+	}
+}
+
+// =====================================================================================================
+// documentHandler
+// =====================================================================================================
+
+// GET, PUT and DELETE /documents/{name}?context= for the value of a plugin
+// instance in a client document. Instances with an alias keep their value
+// across sessions.
+func documentHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !clientDocuments[name] {
+		http.Error(w, "No such document", 404)
+		return
+	}
+	context := r.URL.Query().Get("context")
+	if context == "" {
+		http.Error(w, "No context specified", 400)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		value, err := GetInstanceDocument(name, context)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if value == nil {
+			http.Error(w, "Nothing stored for this context", 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(value)
+	case http.MethodPut:
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDocumentBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !json.Valid(body) {
+			http.Error(w, "Body is not valid JSON", 400)
+			return
+		}
+		if err := PutInstanceDocument(name, context, body); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := PutInstanceDocument(name, context, nil); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	http.HandleFunc("/documents/{name}", documentHandler)
+}
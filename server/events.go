@@ -0,0 +1,393 @@
+// =====================================================================================================
+// File:           events.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Per context parameter change feed with WebSocket and Server-Sent Events endpoints
+// =====================================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+const (
+	// Number of events buffered per subscriber before events are dropped
+	subscriberQueueLen = 64
+	// Number of events kept per context for Last-Event-ID resume
+	feedHistoryLen = 256
+	// Interval between keep-alive comments on event streams
+	heartbeatInterval = 15 * time.Second
+)
+
+// ParameterEvent is one parameter change as reported by a plugin.
+type ParameterEvent struct {
+	Id      uint64    `json:"id"`
+	Context string    `json:"context"`
+	Type    string    `json:"type"`
+	Key     string    `json:"key"`
+	Kind    string    `json:"kind"`
+	Value   string    `json:"value"`
+	Time    time.Time `json:"time"`
+}
+
+// Command sent by a browser on the parameter socket
+type SocketCommand struct {
+	Cmd   string `json:"cmd"`
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type SocketError struct {
+	Error string `json:"error"`
+}
+
+// Change feed of a plugin instance, kept under the alias of its connection
+// if it has one, so streams opened for the alias outlive reconnects.
+type feed struct {
+	key         string // Alias or context the feed is kept under
+	seq         uint64
+	history     []ParameterEvent
+	subscribers map[chan ParameterEvent]struct{}
+	closed      bool // Connection gone, the feed goes with its last subscriber
+}
+
+// =====================================================================================================
+// Local state
+// =====================================================================================================
+
+var (
+	feeds   = make(map[string]*feed) // By contextKey
+	feedsMu sync.Mutex
+)
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+// Must be called holding feedsMu.
+func getFeed(key string) *feed {
+	f := feeds[key]
+	if f == nil {
+		f = &feed{key: key, subscribers: make(map[chan ParameterEvent]struct{})}
+		feeds[key] = f
+	}
+	return f
+}
+
+func feedKey(context string) string {
+	key, _ := contextKey(context)
+	return key
+}
+
+// Keep the subscribers of a renamed alias.
+func renameFeed(old string, name string) {
+	feedsMu.Lock()
+	defer feedsMu.Unlock()
+	if f, ok := feeds[old]; ok {
+		f.key = name
+		feeds[name] = f
+		delete(feeds, old)
+	}
+}
+
+// Resolver of the connection currently serving a context, which for an
+// alias follows reconnects and renames.
+func followContext(context string) func() string {
+	fk := feedKey(context)
+	feedsMu.Lock()
+	f := getFeed(fk)
+	feedsMu.Unlock()
+	return func() string {
+		feedsMu.Lock()
+		key := f.key
+		feedsMu.Unlock()
+		return ResolveContext(key)
+	}
+}
+
+// Forget the feed of a closed connection without alias, or once its last
+// subscriber has left.
+func dropFeed(key string) {
+	feedsMu.Lock()
+	defer feedsMu.Unlock()
+	if f, ok := feeds[key]; ok {
+		if len(f.subscribers) == 0 {
+			delete(feeds, key)
+		} else {
+			f.closed = true
+		}
+	}
+}
+
+// Publish a parameter change to all subscribers of the context. Slow
+// subscribers lose events rather than blocking the UI connection.
+func Publish(context string, key StateKey, value StateValue) {
+	fk := feedKey(context)
+	feedsMu.Lock()
+	defer feedsMu.Unlock()
+	f := getFeed(fk)
+	f.closed = false
+	f.seq++
+	event := ParameterEvent{Id: f.seq, Context: context, Type: key.Type, Key: key.Key, Kind: value.Kind, Value: value.String(), Time: value.Updated}
+	f.history = append(f.history, event)
+	if len(f.history) > feedHistoryLen {
+		f.history = f.history[len(f.history)-feedHistoryLen:]
+	}
+	for ch := range f.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Dropping event %d for slow subscriber on %s", event.Id, context)
+		}
+	}
+}
+
+// Subscribe to the change feed of a context. A context with an alias is
+// followed to the connections serving the alias later. The returned function
+// must be called to unsubscribe.
+func Subscribe(context string) (<-chan ParameterEvent, func()) {
+	_, _, ch, unsubscribe := SubscribeAfter(context, 0)
+	return ch, unsubscribe
+}
+
+// SubscribeAfter subscribes like Subscribe and also returns the events
+// published after lastId. If the history no longer reaches back to lastId
+// ok is false and the caller has to resynchronise from the state cache.
+func SubscribeAfter(context string, lastId uint64) (missed []ParameterEvent, ok bool, events <-chan ParameterEvent, unsubscribe func()) {
+	ch := make(chan ParameterEvent, subscriberQueueLen)
+	fk := feedKey(context)
+	feedsMu.Lock()
+	f := getFeed(fk)
+	f.subscribers[ch] = struct{}{}
+	ok = lastId <= f.seq && (len(f.history) == 0 || f.history[0].Id <= lastId+1)
+	if ok {
+		for _, event := range f.history {
+			if event.Id > lastId {
+				missed = append(missed, event)
+			}
+		}
+	}
+	feedsMu.Unlock()
+	return missed, ok, ch, func() {
+		feedsMu.Lock()
+		delete(f.subscribers, ch)
+		if f.closed && len(f.subscribers) == 0 && feeds[fk] == f {
+			delete(feeds, fk)
+		}
+		feedsMu.Unlock()
+	}
+}
+
+func stateEvents(context string) []ParameterEvent {
+	state, _ := ConnectionState(context)
+	events := make([]ParameterEvent, 0, len(state))
+	for key, value := range state {
+		events = append(events, ParameterEvent{Context: context, Type: key.Type, Key: key.Key, Kind: value.Kind, Value: value.String(), Time: value.Updated})
+	}
+	if offer, ok := RestoreOffer(context); ok {
+		events = append(events, offer.event(context))
+	}
+	return events
+}
+
+// Commands act on the connection the context resolves to when they arrive.
+func readSocketCommands(ws *WebSocket, context func() string) {
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var cmd SocketCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			ws.WriteJSON(SocketError{Error: "Invalid command: " + err.Error()})
+			continue
+		}
+		switch cmd.Cmd {
+		case "set":
+			_, err := EditParameter(context(), Setting{Type: cmd.Type, Key: cmd.Key, Value: cmd.Value})
+			var verr *ValidationError
+			if errors.As(err, &verr) {
+				ws.WriteJSON(verr)
+			} else if err != nil {
+				ws.WriteJSON(SocketError{Error: err.Error()})
+			}
+		case "begin", "end":
+			if err := Gesture(context(), cmd.Type, cmd.Key, cmd.Cmd == "begin"); err != nil {
+				ws.WriteJSON(SocketError{Error: err.Error()})
+			}
+		default:
+			ws.WriteJSON(SocketError{Error: "Unknown command: " + cmd.Cmd})
+		}
+	}
+}
+
+// =====================================================================================================
+// parameterSocketHandler
+// =====================================================================================================
+
+// Streams every parameter change of a context as JSON ParameterEvent
+// messages, starting with the currently known state, and accepts
+// {"cmd":"set","type":..,"key":..,"value":..} messages as well as
+// {"cmd":"begin"|"end","type":..,"key":..} gesture markers.
+func parameterSocketHandler(w http.ResponseWriter, r *http.Request) {
+	context := r.URL.Query().Get("context")
+	if context == "" {
+		http.Error(w, "No context specified", 400)
+		return
+	}
+
+	events, unsubscribe := Subscribe(context)
+	defer unsubscribe()
+	target := followContext(context)
+
+	ws, err := UpgradeWebSocket(w, r)
+	if err != nil {
+		log.Println("WebSocket upgrade failed:", err)
+		return
+	}
+	defer ws.Close()
+
+	done := make(chan struct{})
+	go func() {
+		readSocketCommands(ws, target)
+		close(done)
+	}()
+
+	for _, event := range stateEvents(context) {
+		if err := ws.WriteJSON(event); err != nil {
+			return
+		}
+	}
+
+	for {
+		select {
+		case event := <-events:
+			if err := ws.WriteJSON(event); err != nil {
+				log.Println("WebSocket write failed:", err)
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// =====================================================================================================
+// parameterEventsHandler
+// =====================================================================================================
+
+func writeServerEvent(w http.ResponseWriter, event ParameterEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if event.Id > 0 {
+		fmt.Fprintf(w, "id: %d\n", event.Id)
+	}
+	name := "parameter"
+	if event.Type == restoreEventType {
+		name = restoreEventType
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	return err
+}
+
+// Streams the parameter changes of a context as text/event-stream. A client
+// resuming with Last-Event-ID (header or lastEventId query parameter) gets
+// the events it missed, or the full current state if they are no longer in
+// the history.
+func parameterEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	context := r.URL.Query().Get("context")
+	if context == "" {
+		http.Error(w, "No context specified", 400)
+		return
+	}
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("lastEventId")
+	}
+	var lastId uint64
+	resume := false
+	if lastEventId != "" {
+		id, err := strconv.ParseUint(lastEventId, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", 400)
+			return
+		}
+		lastId = id
+		resume = true
+	}
+
+	rc := http.NewResponseController(w)
+	// The stream outlives the http.Server write timeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "Streaming not supported", 500)
+		return
+	}
+
+	missed, ok, events, unsubscribe := SubscribeAfter(context, lastId)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if !resume || !ok {
+		missed = stateEvents(context)
+	}
+	for _, event := range missed {
+		if err := writeServerEvent(w, event); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event := <-events:
+			if err := writeServerEvent(w, event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	http.HandleFunc("/madigan-parameter/ws", parameterSocketHandler)
+	http.HandleFunc("/madigan-parameter/events", parameterEventsHandler)
+}
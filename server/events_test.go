@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func hasFeed(key string) bool {
+	feedsMu.Lock()
+	defer feedsMu.Unlock()
+	_, ok := feeds[key]
+	return ok
+}
+
+func TestFeedDroppedWithConnection(t *testing.T) {
+	ui := connectTestUI(t, "feed-gone", ProtocolJSON, testInfo())
+	handleUIMessage(ui.conn, Message{"type": "control", "key": "1", "kind": KindFloat, "value": "0.5"})
+	unregisterConnection(ui.conn)
+	if hasFeed("feed-gone") {
+		t.Fatal("feed of a closed connection without alias should be dropped")
+	}
+}
+
+func TestFeedDroppedWithLastSubscriber(t *testing.T) {
+	ui := connectTestUI(t, "feed-watched", ProtocolJSON, testInfo())
+	_, unsubscribe := Subscribe("feed-watched")
+	unregisterConnection(ui.conn)
+	if !hasFeed("feed-watched") {
+		t.Fatal("feed should be kept while it has subscribers")
+	}
+	unsubscribe()
+	if hasFeed("feed-watched") {
+		t.Fatal("feed should be dropped with its last subscriber")
+	}
+}
+
+func TestSocketCommandsFollowRename(t *testing.T) {
+	alias := AssignAlias(Identity{Host: "events-host", Instance: "Socket Rename", Plugin: "urn:test"})
+	ui := connectTestUI(t, "socket-rename", ProtocolJSON, testInfo())
+	mu.Lock()
+	ui.conn.Alias = alias
+	mu.Unlock()
+
+	_, unsubscribe := Subscribe("socket-rename")
+	defer unsubscribe()
+	ws, client := newTestSocket(t)
+	done := make(chan struct{})
+	go func() {
+		readSocketCommands(ws, followContext("socket-rename"))
+		close(done)
+	}()
+	defer func() {
+		client.conn.Close()
+		<-done
+	}()
+
+	if err := RenameAlias(alias, "socket-renamed"); err != nil {
+		t.Fatal(err)
+	}
+	client.send(t, clientFrame(true, 1, []byte(`{"cmd":"set","type":"control","key":"1","value":"0.5"}`)))
+	if m := ui.next(t); m["cmd"] != "set" || m["key"] != "1" || m["value"] != "0.5" {
+		t.Fatalf("expected the set after the rename, got %v", m)
+	}
+}
+
+// Event stream of a context, with the Last-Event-ID to resume from if set.
+func openEventStream(t *testing.T, context string, lastEventId string) (*bufio.Reader, int) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(parameterEventsHandler))
+	r, err := http.NewRequest(http.MethodGet, server.URL+"?context="+context, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventId != "" {
+		r.Header.Set("Last-Event-ID", lastEventId)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		resp.Body.Close()
+		server.Close()
+	})
+	return bufio.NewReader(resp.Body), resp.StatusCode
+}
+
+// Next event of a stream, with the id it was sent with (0 for none).
+func nextServerEvent(t *testing.T, stream *bufio.Reader) (uint64, ParameterEvent) {
+	t.Helper()
+	var id uint64
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatal("reading event stream:", err)
+		}
+		if value, ok := strings.CutPrefix(line, "id: "); ok {
+			id, _ = strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var event ParameterEvent
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatal(err)
+			}
+			return id, event
+		}
+	}
+}
+
+func TestEventStreamResume(t *testing.T) {
+	ui := connectTestUI(t, "events-resume", ProtocolJSON, testInfo())
+	ui.report(map[string]string{"1": "0.1"})
+	ui.report(map[string]string{"1": "0.2"})
+	ui.report(map[string]string{"1": "0.3"})
+
+	// The events after the one last seen, then the live ones
+	stream, _ := openEventStream(t, "events-resume", "1")
+	for _, want := range []string{"0.2", "0.3"} {
+		if id, event := nextServerEvent(t, stream); id == 0 || event.Value != want {
+			t.Fatalf("expected the missed event %s, got id %d %+v", want, id, event)
+		}
+	}
+	ui.report(map[string]string{"1": "0.4"})
+	if id, event := nextServerEvent(t, stream); id != 4 || event.Value != "0.4" {
+		t.Fatalf("expected live event 4, got id %d %+v", id, event)
+	}
+}
+
+func TestEventStreamResyncs(t *testing.T) {
+	ui := connectTestUI(t, "events-resync", ProtocolJSON, testInfo())
+	// One event more than the history keeps after the first one
+	last := strconv.Itoa(feedHistoryLen + 1)
+	for i := 0; i <= feedHistoryLen+1; i++ {
+		ui.report(map[string]string{"1": strconv.Itoa(i)})
+	}
+
+	// Without Last-Event-ID, and when it is older than the history, the
+	// stream starts with the current state
+	for _, lastEventId := range []string{"", "1"} {
+		stream, _ := openEventStream(t, "events-resync", lastEventId)
+		if id, event := nextServerEvent(t, stream); id != 0 || event.Key != "1" || event.Value != last {
+			t.Errorf("Last-Event-ID %q: expected the state of port 1, got id %d %+v", lastEventId, id, event)
+		}
+	}
+	if _, status := openEventStream(t, "events-resync", "latest"); status != http.StatusBadRequest {
+		t.Errorf("invalid Last-Event-ID: got status %d", status)
+	}
+}
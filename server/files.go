@@ -0,0 +1,282 @@
+// =====================================================================================================
+// File:           files.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Web server service handler browsing the media directories for path parameters
+// =====================================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+type MediaRoot struct {
+	Id   string `json:"id"`
+	Path string `json:"path"`
+}
+
+type FileEntry struct {
+	Name  string    `json:"name"`
+	Path  string    `json:"path"` // Absolute, as passed to the plugin
+	Dir   bool      `json:"dir,omitempty"`
+	Size  int64     `json:"size"`
+	MTime time.Time `json:"mtime"`
+}
+
+type FileListing struct {
+	Root    string      `json:"root"`
+	Path    string      `json:"path"` // Relative to the root
+	Types   []string    `json:"types,omitempty"`
+	Entries []FileEntry `json:"entries"`
+}
+
+// Extensions for the file type categories used in mod:fileTypes. Types not
+// listed here are taken as file extensions.
+var fileTypeExtensions = map[string][]string{
+	"audioloop":      {"wav", "flac", "ogg", "mp3", "aif", "aiff"},
+	"audiorecording": {"wav", "flac", "ogg", "mp3", "aif", "aiff"},
+	"audiosample":    {"wav", "flac", "ogg", "mp3", "aif", "aiff"},
+	"audiotrack":     {"wav", "flac", "ogg", "mp3", "aif", "aiff"},
+	"cabsim":         {"wav", "flac"},
+	"ir":             {"wav", "flac"},
+	"h2drumkit":      {"h2drumkit"},
+	"midiclip":       {"mid", "midi"},
+	"midisong":       {"mid", "midi"},
+	"sf2":            {"sf2", "sf3"},
+	"sfz":            {"sfz"},
+	"nammodel":       {"nam"},
+	"aidadspmodel":   {"json", "aidax"},
+}
+
+var (
+	errNoSuchRoot = errors.New("no such media root")
+	errBadPath    = errors.New("path outside media root")
+)
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+func mediaRoots() []MediaRoot {
+	roots := make([]MediaRoot, 0, len(mediaDirs))
+	for i, dir := range mediaDirs {
+		roots = append(roots, MediaRoot{Id: strconv.Itoa(i), Path: dir})
+	}
+	return roots
+}
+
+// Resolve a root id and a slash separated path below it. The returned
+// relative path is clean and never leaves the root.
+func mediaPath(rootId string, rel string) (root string, clean string, err error) {
+	i, err := strconv.Atoi(rootId)
+	if err != nil || i < 0 || i >= len(mediaDirs) {
+		return "", "", errNoSuchRoot
+	}
+	clean = path.Clean("/" + rel)[1:]
+	if clean == "" {
+		clean = "."
+	}
+	if !fs.ValidPath(clean) {
+		return "", "", errBadPath
+	}
+	return mediaDirs[i], clean, nil
+}
+
+// Check that rel does not lead outside rootDir through symlinks and return
+// it with the symlinks resolved, relative to rootDir and slash separated.
+// The deepest existing part of the path is resolved, what is still to be
+// created can't point anywhere yet. os.Root refuses absolute symlinks even
+// when they stay inside the root, the resolved path has none left.
+func confinedPath(rootDir string, rel string) (string, error) {
+	base, err := filepath.EvalSymlinks(rootDir)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(rootDir, filepath.FromSlash(rel))
+	tail := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			inside, err := filepath.Rel(base, resolved)
+			if err != nil || !filepath.IsLocal(inside) && inside != "." {
+				return "", errBadPath
+			}
+			return path.Join(filepath.ToSlash(inside), tail), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return rel, nil
+		}
+		tail = path.Join(filepath.Base(p), tail)
+		p = parent
+	}
+}
+
+// Allowed extensions, lower case without dot, for a list of file types.
+func fileExtensions(types []string) map[string]bool {
+	if len(types) == 0 {
+		return nil
+	}
+	result := make(map[string]bool)
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimPrefix(t, "."))
+		if exts, ok := fileTypeExtensions[t]; ok {
+			for _, ext := range exts {
+				result[ext] = true
+			}
+		} else {
+			result[t] = true
+		}
+	}
+	return result
+}
+
+func hasExtension(name string, exts map[string]bool) bool {
+	if exts == nil {
+		return true
+	}
+	return exts[strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))]
+}
+
+// File types declared by a patch parameter of a connected plugin.
+func parameterFileTypes(context string, key string) []string {
+	info, _ := ConnectionParamInfo(context).Param("patch", key)
+	return info.FileTypes
+}
+
+// List a directory below a media root. Symlinks are followed as long as they
+// stay inside the root, os.Root enforces that on every access.
+func listMediaDir(rootId string, rel string, types []string) (FileListing, error) {
+	rootDir, clean, err := mediaPath(rootId, rel)
+	if err != nil {
+		return FileListing{}, err
+	}
+	resolved, err := confinedPath(rootDir, clean)
+	if err != nil {
+		return FileListing{}, err
+	}
+	root, err := os.OpenRoot(rootDir)
+	if err != nil {
+		return FileListing{}, err
+	}
+	defer root.Close()
+
+	dir, err := root.Open(resolved)
+	if err != nil {
+		return FileListing{}, err
+	}
+	defer dir.Close()
+	dirEntries, err := dir.ReadDir(-1)
+	if err != nil {
+		return FileListing{}, err
+	}
+
+	exts := fileExtensions(types)
+	listing := FileListing{Root: rootId, Path: clean, Types: types, Entries: make([]FileEntry, 0, len(dirEntries))}
+	for _, dirEntry := range dirEntries {
+		if strings.HasPrefix(dirEntry.Name(), ".") {
+			continue
+		}
+		// Symlinks leading outside the root are left out
+		entry, err := confinedPath(rootDir, path.Join(resolved, dirEntry.Name()))
+		if err != nil {
+			continue
+		}
+		info, err := root.Stat(entry)
+		if err != nil {
+			continue
+		}
+		if !info.IsDir() && (!info.Mode().IsRegular() || !hasExtension(info.Name(), exts)) {
+			continue
+		}
+		listing.Entries = append(listing.Entries, FileEntry{
+			Name:  dirEntry.Name(),
+			Path:  filepath.Join(rootDir, filepath.FromSlash(clean), dirEntry.Name()),
+			Dir:   info.IsDir(),
+			Size:  info.Size(),
+			MTime: info.ModTime(),
+		})
+	}
+	sort.Slice(listing.Entries, func(i, j int) bool {
+		a, b := listing.Entries[i], listing.Entries[j]
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+	return listing, nil
+}
+
+func fileErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNoSuchRoot), errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, errBadPath), errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// =====================================================================================================
+// filesHandler
+// =====================================================================================================
+
+// Without root, lists the media roots. With root and path, lists that
+// directory. Files are filtered by the types query parameter (comma
+// separated) or by the file types of the patch parameter given by context
+// and key.
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+
+	rootId := query.Get("root")
+	if rootId == "" {
+		json.NewEncoder(w).Encode(mediaRoots())
+		return
+	}
+
+	var types []string
+	if t := query.Get("types"); t != "" {
+		types = strings.Split(t, ",")
+	} else if query.Get("context") != "" && query.Get("key") != "" {
+		types = parameterFileTypes(query.Get("context"), query.Get("key"))
+	}
+
+	listing, err := listMediaDir(rootId, query.Get("path"), types)
+	if err != nil {
+		w.Header().Del("Content-Type")
+		http.Error(w, err.Error(), fileErrorStatus(err))
+		return
+	}
+	json.NewEncoder(w).Encode(listing)
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	http.HandleFunc("/files", filesHandler)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A media root holding sub/kick.wav and notes.txt, with a directory outside
+// it holding secret.wav. Returns the root and the outside directory.
+func testMediaRoot(t *testing.T) (string, string) {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "media")
+	outside := filepath.Join(t.TempDir(), "outside")
+	for _, file := range []string{
+		filepath.Join(root, "sub", "kick.wav"),
+		filepath.Join(root, "notes.txt"),
+		filepath.Join(outside, "secret.wav"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(saved []string) { t.Cleanup(func() { mediaDirs = saved }) }(mediaDirs)
+	mediaDirs = []string{root}
+	return root, outside
+}
+
+func TestConfinedPath(t *testing.T) {
+	root, outside := testMediaRoot(t)
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "inner")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rel  string
+		want string // Empty when rel leads outside the root
+	}{
+		{".", "."},
+		{"sub/kick.wav", "sub/kick.wav"},
+		{"sub/new/file.wav", "sub/new/file.wav"},
+		{"inner", "sub"},
+		{"inner/kick.wav", "sub/kick.wav"},
+		{"inner/new/file.wav", "sub/new/file.wav"},
+		{"../outside", ""},
+		{"sub/../../outside/secret.wav", ""},
+		{"escape", ""},
+		{"escape/secret.wav", ""},
+		{"escape/new.wav", ""},
+	}
+	for _, test := range tests {
+		got, err := confinedPath(root, test.rel)
+		if test.want == "" && !errors.Is(err, errBadPath) {
+			t.Errorf("confinedPath(%q) = %q %v, want %v", test.rel, got, err, errBadPath)
+		}
+		if test.want != "" && (err != nil || got != test.want) {
+			t.Errorf("confinedPath(%q) = %q %v, want %q", test.rel, got, err, test.want)
+		}
+	}
+}
+
+func listingNames(listing FileListing) []string {
+	names := make([]string, 0, len(listing.Entries))
+	for _, entry := range listing.Entries {
+		names = append(names, entry.Name)
+	}
+	return names
+}
+
+func TestListMediaDir(t *testing.T) {
+	root, outside := testMediaRoot(t)
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "inner")); err != nil {
+		t.Fatal(err)
+	}
+
+	listing, err := listMediaDir("0", "", []string{"audiosample"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The escaping symlink is skipped, the one inside the root is listed
+	if names := listingNames(listing); len(names) != 2 || names[0] != "inner" || names[1] != "sub" {
+		t.Errorf("root listing: got %v, want [inner sub]", names)
+	}
+	listing, err = listMediaDir("0", "inner", []string{"audiosample"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Entries) != 1 || listing.Entries[0].Path != filepath.Join(root, "inner", "kick.wav") {
+		t.Errorf("listing through the inner symlink: got %+v", listing.Entries)
+	}
+
+	// Traversal and absolute paths are taken relative to the root
+	for _, rel := range []string{"../", "../../", "/"} {
+		listing, err := listMediaDir("0", rel, nil)
+		if err != nil || listing.Path != "." {
+			t.Errorf("%q: got path %q %v, want the root", rel, listing.Path, err)
+		}
+	}
+	if _, err := listMediaDir("0", outside, nil); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("absolute path outside the root: got %v, want not found below the root", err)
+	}
+	for _, rel := range []string{"escape", "escape/", "../escape"} {
+		if _, err := listMediaDir("0", rel, nil); !errors.Is(err, errBadPath) {
+			t.Errorf("%q: got %v, want %v", rel, err, errBadPath)
+		}
+	}
+	if _, err := listMediaDir("1", "", nil); !errors.Is(err, errNoSuchRoot) {
+		t.Errorf("unknown root: got %v, want %v", err, errNoSuchRoot)
+	}
+}
@@ -0,0 +1,263 @@
+// =====================================================================================================
+// File:           history.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Undo/redo journal of parameter edits made through /madigan-parameter
+// =====================================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+type HistoryChange struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// A step is undone and redone as a whole. Edits of one parameter make steps
+// of one change, batches, preset loads, recalls and morphs one step of all
+// the parameters they set.
+type HistoryStep struct {
+	Changes []HistoryChange `json:"changes"`
+	Started time.Time       `json:"started"`
+	Updated time.Time       `json:"updated"` // Last edit coalesced into the step
+}
+
+type History struct {
+	Undo []HistoryStep `json:"undo"` // Oldest first
+	Redo []HistoryStep `json:"redo"` // Next to redo last
+}
+
+var errNothingToUndo = errors.New("nothing to undo")
+var errNothingToRedo = errors.New("nothing to redo")
+
+// =====================================================================================================
+// Local state
+// =====================================================================================================
+
+var (
+	histories = make(map[string]*History)
+	historyMu sync.Mutex
+)
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+// CurrentValue is the value a parameter has before an edit: the cached
+// value, or the default for control ports that have not reported yet.
+func CurrentValue(context string, typ string, key string) (string, bool) {
+	state, ok := ConnectionState(context)
+	if !ok {
+		return "", false
+	}
+	if value, ok := state[StateKey{Type: typ, Key: key}]; ok {
+		return value.String(), true
+	}
+	if typ == "control" {
+		if info, ok := ConnectionParamInfo(context).Param(typ, key); ok {
+			return strconv.FormatFloat(float64(info.Default), 'f', -1, 32), true
+		}
+	}
+	return "", false
+}
+
+// Must be called holding historyMu.
+func historyOf(context string) *History {
+	h := histories[context]
+	if h == nil {
+		h = &History{Undo: make([]HistoryStep, 0), Redo: make([]HistoryStep, 0)}
+		histories[context] = h
+	}
+	return h
+}
+
+// RecordEdit journals a parameter change. A change to the same parameter
+// as the previous step within undoCoalesce extends that step.
+func RecordEdit(context string, typ string, key string, old string, value string) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	h := historyOf(context)
+	now := time.Now()
+	h.Redo = h.Redo[:0]
+
+	if n := len(h.Undo); n > 0 {
+		last := &h.Undo[n-1]
+		if len(last.Changes) == 1 && last.Changes[0].Type == typ && last.Changes[0].Key == key && now.Sub(last.Updated) < undoCoalesce {
+			last.Changes[0].New = value
+			last.Updated = now
+			return
+		}
+	}
+	h.push(HistoryStep{Changes: []HistoryChange{{Type: typ, Key: key, Old: old, New: value}}, Started: now, Updated: now})
+}
+
+// RecordEdits journals changes made together as one step, which is never
+// coalesced with other edits.
+func RecordEdits(context string, changes []HistoryChange) {
+	if len(changes) == 0 {
+		return
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	h := historyOf(context)
+	now := time.Now()
+	h.Redo = h.Redo[:0]
+	h.push(HistoryStep{Changes: changes, Started: now, Updated: now})
+}
+
+// Must be called holding historyMu.
+func (h *History) push(step HistoryStep) {
+	h.Undo = append(h.Undo, step)
+	if over := len(h.Undo) - int(undoDepth); over > 0 {
+		h.Undo = append(h.Undo[:0], h.Undo[over:]...)
+	}
+}
+
+func ListHistory(context string) History {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	h := historyOf(context)
+	return History{Undo: append([]HistoryStep(nil), h.Undo...), Redo: append([]HistoryStep(nil), h.Redo...)}
+}
+
+// Validate a setting, send it to the UI of a connection and record it for
+// undo. This is the path for edits made by a client. Returns the command sent.
+func EditParameter(context string, setting Setting) (string, error) {
+	if GetPluginUri(context) == "" {
+		return "", ErrNoConnection
+	}
+	value, err := ValidateSetting(ConnectionParamInfo(context), setting)
+	if err != nil {
+		return "", err
+	}
+	old, known := CurrentValue(context, setting.Type, setting.Key)
+	cmd, err := SetParameter(context, setting.Type, setting.Key, value)
+	if err != nil {
+		return "", err
+	}
+	if known {
+		RecordEdit(context, setting.Type, setting.Key, old, value)
+	}
+	return cmd, nil
+}
+
+// Forget the history of a context.
+func dropHistory(context string) {
+	historyMu.Lock()
+	delete(histories, context)
+	historyMu.Unlock()
+}
+
+// Undo the last step, or redo the last undone one, by sending the recorded
+// values. A step of one change is sent as a set command, a group as one
+// batch in reverse order for undo.
+func stepHistory(context string, redo bool) (HistoryStep, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	h := historyOf(context)
+	from, to := &h.Undo, &h.Redo
+	if redo {
+		from, to = to, from
+	}
+	if len(*from) == 0 {
+		if redo {
+			return HistoryStep{}, errNothingToRedo
+		}
+		return HistoryStep{}, errNothingToUndo
+	}
+	step := (*from)[len(*from)-1]
+	settings := make([]Setting, len(step.Changes))
+	for i, change := range step.Changes {
+		if redo {
+			settings[i] = Setting{Type: change.Type, Key: change.Key, Value: change.New}
+		} else {
+			settings[len(settings)-1-i] = Setting{Type: change.Type, Key: change.Key, Value: change.Old}
+		}
+	}
+	var err error
+	if len(settings) == 1 {
+		_, err = SetParameter(context, settings[0].Type, settings[0].Key, settings[0].Value)
+	} else {
+		_, _, err = applyParameters(context, settings)
+	}
+	if err != nil {
+		return HistoryStep{}, err
+	}
+	*from = (*from)[:len(*from)-1]
+	*to = append(*to, step)
+	return step, nil
+}
+
+func historyErrorStatus(err error) int {
+	if errors.Is(err, errNothingToUndo) || errors.Is(err, errNothingToRedo) {
+		return 409
+	}
+	return sendErrorStatus(err)
+}
+
+// =====================================================================================================
+// historyHandler
+// =====================================================================================================
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	context := r.URL.Query().Get("context")
+	if context == "" {
+		http.Error(w, "No context specified", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ListHistory(context))
+}
+
+// =====================================================================================================
+// undoHandler, redoHandler
+// =====================================================================================================
+func stepHistoryHandler(redo bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		context := r.URL.Query().Get("context")
+		if context == "" {
+			http.Error(w, "No context specified", 400)
+			return
+		}
+		step, err := stepHistory(context, redo)
+		if err != nil {
+			http.Error(w, err.Error(), historyErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(step)
+	}
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	http.HandleFunc("/history", historyHandler)
+	http.HandleFunc("/history/undo", stepHistoryHandler(false))
+	http.HandleFunc("/history/redo", stepHistoryHandler(true))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRecordEditCoalesces(t *testing.T) {
+	defer func(saved time.Duration) { undoCoalesce = saved }(undoCoalesce)
+	undoCoalesce = time.Hour
+
+	context := "history-coalesce"
+	dropHistory(context)
+	RecordEdit(context, "control", "1", "0", "0.2")
+	RecordEdit(context, "control", "1", "0.2", "0.5")
+	RecordEdit(context, "control", "2", "0", "1")
+	RecordEdit(context, "control", "1", "0.5", "0.7")
+
+	h := ListHistory(context)
+	if len(h.Undo) != 3 {
+		t.Fatalf("expected 3 steps, got %+v", h.Undo)
+	}
+	first := h.Undo[0].Changes[0]
+	if first.Key != "1" || first.Old != "0" || first.New != "0.5" {
+		t.Errorf("first step should span 0 -> 0.5, got %+v", first)
+	}
+	if last := h.Undo[2].Changes[0]; last.Key != "1" || last.Old != "0.5" || last.New != "0.7" {
+		t.Errorf("edit after another parameter should start a step, got %+v", last)
+	}
+}
+
+func TestRecordEditAfterPause(t *testing.T) {
+	defer func(saved time.Duration) { undoCoalesce = saved }(undoCoalesce)
+	undoCoalesce = 0
+
+	context := "history-pause"
+	dropHistory(context)
+	RecordEdit(context, "control", "1", "0", "0.2")
+	RecordEdit(context, "control", "1", "0.2", "0.5")
+	if h := ListHistory(context); len(h.Undo) != 2 {
+		t.Fatalf("edits outside the coalesce window should be separate steps, got %+v", h.Undo)
+	}
+}
+
+func TestRecordEditsIsOneStep(t *testing.T) {
+	defer func(saved time.Duration) { undoCoalesce = saved }(undoCoalesce)
+	undoCoalesce = time.Hour
+
+	context := "history-group"
+	dropHistory(context)
+	RecordEdit(context, "control", "1", "0", "0.2")
+	RecordEdits(context, []HistoryChange{
+		{Type: "control", Key: "1", Old: "0.2", New: "0.4"},
+		{Type: "control", Key: "2", Old: "0", New: "1"},
+	})
+	RecordEdit(context, "control", "1", "0.4", "0.6")
+	RecordEdits(context, nil)
+
+	h := ListHistory(context)
+	if len(h.Undo) != 3 || len(h.Undo[1].Changes) != 2 {
+		t.Fatalf("expected the group as a step of its own, got %+v", h.Undo)
+	}
+}
+
+func TestRecordEditDepth(t *testing.T) {
+	defer func(saved int64) { undoDepth = saved }(undoDepth)
+	undoDepth = 3
+
+	context := "history-depth"
+	dropHistory(context)
+	for _, key := range []string{"1", "2", "3", "4", "5"} {
+		RecordEdit(context, "control", key, "0", "1")
+	}
+	h := ListHistory(context)
+	if len(h.Undo) != 3 || h.Undo[0].Changes[0].Key != "3" || h.Undo[2].Changes[0].Key != "5" {
+		t.Fatalf("expected the 3 latest steps, got %+v", h.Undo)
+	}
+}
+
+func TestUndoRedo(t *testing.T) {
+	ui := connectTestUI(t, "history-ui", ProtocolJSON, testInfo())
+	dropHistory("history-ui")
+
+	// The port has not reported, so the old value is its default
+	if _, err := EditParameter("history-ui", Setting{Type: "control", Key: "1", Value: "0.5"}); err != nil {
+		t.Fatal(err)
+	}
+	if m := ui.next(t); m["cmd"] != "set" || m["value"] != "0.5" {
+		t.Fatalf("expected set 0.5, got %v", m)
+	}
+
+	step, err := stepHistory("history-ui", false)
+	if err != nil || step.Changes[0].Old != "0.25" {
+		t.Fatalf("undo: %+v %v", step, err)
+	}
+	if m := ui.next(t); m["value"] != "0.25" {
+		t.Fatalf("undo should send the old value, got %v", m)
+	}
+	if _, err := stepHistory("history-ui", false); !errors.Is(err, errNothingToUndo) {
+		t.Fatalf("expected nothing to undo, got %v", err)
+	}
+
+	if _, err := stepHistory("history-ui", true); err != nil {
+		t.Fatal("redo:", err)
+	}
+	if m := ui.next(t); m["value"] != "0.5" {
+		t.Fatalf("redo should send the new value, got %v", m)
+	}
+
+	stepHistory("history-ui", false)
+	ui.next(t)
+	RecordEdit("history-ui", "control", "1", "0.25", "0.75")
+	if h := ListHistory("history-ui"); len(h.Redo) != 0 {
+		t.Fatalf("a new edit should clear redo, got %+v", h.Redo)
+	}
+}
+
+func TestUndoRedoGroup(t *testing.T) {
+	ui := connectTestUI(t, "history-group-ui", ProtocolJSON, testInfo())
+	dropHistory("history-group-ui")
+	handleUIMessage(ui.conn, Message{"type": "patch", "key": "urn:test#cutoff", "kind": KindFloat, "value": "100"})
+
+	if _, err := SetParameters("history-group-ui", []Setting{
+		{Type: "control", Key: "1", Value: "0.5"},
+		{Type: "patch", Key: "urn:test#cutoff", Value: "440"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ui.next(t)
+	if h := ListHistory("history-group-ui"); len(h.Undo) != 1 || len(h.Undo[0].Changes) != 2 {
+		t.Fatalf("expected one step for the batch, got %+v", h.Undo)
+	}
+
+	if _, err := stepHistory("history-group-ui", false); err != nil {
+		t.Fatal("undo:", err)
+	}
+	m := ui.next(t)
+	var items []batchItem
+	if err := json.Unmarshal([]byte(m["items"]), &items); m["cmd"] != "batch" || err != nil {
+		t.Fatalf("undo should send one batch, got %v", m)
+	}
+	want := []batchItem{
+		{Type: "patch", Key: "urn:test#cutoff", Kind: KindFloat, Value: "100"},
+		{Type: "control", Key: "1", Value: "0.25"},
+	}
+	if len(items) != len(want) || items[0] != want[0] || items[1] != want[1] {
+		t.Fatalf("undo sent %+v, want %+v", items, want)
+	}
+	if h := ListHistory("history-group-ui"); len(h.Undo) != 0 || len(h.Redo) != 1 {
+		t.Fatalf("undo should move the whole step, got %+v", h)
+	}
+
+	if _, err := stepHistory("history-group-ui", true); err != nil {
+		t.Fatal("redo:", err)
+	}
+	m = ui.next(t)
+	if err := json.Unmarshal([]byte(m["items"]), &items); err != nil || len(items) != 2 || items[0].Value != "0.5" || items[1].Value != "440" {
+		t.Fatalf("redo should send the new values, got %v", m)
+	}
+	if h := ListHistory("history-group-ui"); len(h.Undo) != 1 || len(h.Redo) != 0 {
+		t.Fatalf("redo should move the whole step back, got %+v", h)
+	}
+}
+
+func TestHistoryDroppedWithConnection(t *testing.T) {
+	ui := connectTestUI(t, "history-gone", ProtocolJSON, testInfo())
+	RecordEdit("history-gone", "control", "1", "0", "1")
+	unregisterConnection(ui.conn)
+	historyMu.Lock()
+	_, ok := histories["history-gone"]
+	historyMu.Unlock()
+	if ok {
+		t.Fatal("history of a connection without alias should be dropped")
+	}
+}
@@ -0,0 +1,146 @@
+// =====================================================================================================
+// File:           lv2world.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Shared lilv world and plugin metadata cache
+// =====================================================================================================
+
+package main
+
+// #cgo pkg-config: lilv-0
+// #include <lilv/lilv.h>
+// #include <stdlib.h>
+import "C"
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+type ScanResult struct {
+	Plugins  int       `json:"plugins"`
+	Duration float64   `json:"duration"` // seconds
+	Time     time.Time `json:"time"`
+}
+
+// =====================================================================================================
+// Local state
+// =====================================================================================================
+
+var (
+	// lilv is not thread safe, every use of lv2World is done holding lv2Mu
+	lv2World   *C.LilvWorld
+	lv2Mu      sync.Mutex
+	lv2Scan    ScanResult
+	paramCache = make(map[string]AllInfo)
+)
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+// Directories searched for LV2 bundles, as lilv does.
+func lv2PathDirs() []string {
+	path := os.Getenv("LV2_PATH")
+	if path == "" {
+		path = strings.Join([]string{filepath.Join(homeDir(), ".lv2"), "/usr/local/lib/lv2", "/usr/lib/lv2"}, ":")
+	}
+	var dirs []string
+	for _, dir := range filepath.SplitList(path) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// Must be called holding lv2Mu.
+func loadWorld() {
+	start := time.Now()
+	if lv2World != nil {
+		C.lilv_world_free(lv2World)
+	}
+	lv2World = C.lilv_world_new()
+	C.lilv_world_load_all(lv2World)
+	paramCache = make(map[string]AllInfo)
+	pluginCatalogue = nil
+
+	plugins := C.lilv_world_get_all_plugins(lv2World)
+	lv2Scan = ScanResult{
+		Plugins:  int(C.lilv_plugins_size(plugins)),
+		Duration: time.Since(start).Seconds(),
+		Time:     time.Now(),
+	}
+	log.Printf("Loaded %d LV2 plugins in %.2fs", lv2Scan.Plugins, lv2Scan.Duration)
+}
+
+// WithWorld runs f with the shared lilv world, loading it on first use.
+// Nodes and plugins obtained from the world must not be used after f returns.
+func WithWorld(f func(world *C.LilvWorld)) {
+	lv2Mu.Lock()
+	defer lv2Mu.Unlock()
+	if lv2World == nil {
+		loadWorld()
+	}
+	f(lv2World)
+}
+
+// Rescan reloads all LV2 bundles and drops cached plugin metadata.
+func Rescan() ScanResult {
+	lv2Mu.Lock()
+	defer lv2Mu.Unlock()
+	loadWorld()
+	return lv2Scan
+}
+
+// Find a plugin by URI in the world, nil if it is not installed.
+func findPlugin(world *C.LilvWorld, pluginUri string) *C.LilvPlugin {
+	cURI := C.CString(pluginUri)
+	defer C.free(unsafe.Pointer(cURI))
+	uriNode := C.lilv_new_uri(world, cURI)
+	defer C.lilv_node_free(uriNode)
+	return C.lilv_plugins_get_by_uri(C.lilv_world_get_all_plugins(world), uriNode)
+}
+
+// =====================================================================================================
+// RescanHandler
+// =====================================================================================================
+func RescanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Rescan())
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	http.HandleFunc("/rescan", RescanHandler)
+
+	// lilv picks language tagged literals according to LANG
+	if lv2Lang != "" {
+		os.Setenv("LANG", lv2Lang)
+	}
+
+	// Load the world in the background so the first UI connection does not wait for it
+	go WithWorld(func(*C.LilvWorld) {})
+
+	if watchLV2Path {
+		go watchLV2Dirs(lv2PathDirs(), func() { Rescan() })
+	}
+}
@@ -6,23 +6,40 @@ import (
     "log"
     "net"
     "net/http"
-//    "strconv"
-    "strings"
+    "strconv"
     "sync"
 
 
 	"encoding/binary"
+	"errors"
 	"io"
-//	"time"
+	"sync/atomic"
+	"time"
 
 )
 
 type UIConnection struct {
     Conn     net.Conn
-    Reported map[string]string 
+    Reported StateCache
     Id       string
+    Alias    string // Stable name of the plugin instance, empty for UIs without identity hints
     Plugin   string
+    Ordinal  int // Among the UIs of the plugin in the host process
+    Protocol int
     Info     AllInfo
+
+    requests atomic.Uint64
+    pending  map[string]chan Message // Outstanding requests by id, guarded by mu
+    outbox   Outbox
+
+    Connected    time.Time
+    lastActivity atomic.Int64  // Unix nanoseconds of the last frame read or written
+    received     atomic.Uint64 // Frames read from the UI
+    sent         atomic.Uint64 // Frames written to the UI
+
+    writes    chan []byte   // Frames for the writer goroutine
+    done      chan struct{} // Closed when the connection ends
+    closeOnce sync.Once
 }
 
 var (
@@ -40,16 +57,31 @@ func ConnectionParamInfo(id string) AllInfo {
     return con.Info
 }
 
-//func GetPluginUri(id string) string {
-//    var result string
-//    mu.Lock()
-//    con := connections[id];
-//    if con != nil {
-//       result = con.Plugin
-//    }
-//    mu.Unlock()
-//    return result
-//}
+// Copy of the state cache of a connection.
+func ConnectionState(id string) (StateCache, bool) {
+    mu.Lock()
+    defer mu.Unlock()
+    con := connections[id];
+    if con == nil {
+       return nil, false
+    }
+    state := make(StateCache, len(con.Reported))
+    for key, value := range con.Reported {
+       state[key] = value
+    }
+    return state, true
+}
+
+func GetPluginUri(id string) string {
+    var result string
+    mu.Lock()
+    con := connections[id];
+    if con != nil {
+       result = con.Plugin
+    }
+    mu.Unlock()
+    return result
+}
 
 const MaxMessageLen = 16 * 1024 * 1024 // 16 MB safety limit
 
@@ -113,26 +145,6 @@ func tcpHandler() {
     }
 }
 
-func decodeMessage(message string) map[string]string {
-    parts := strings.Split(message, "||");
-    result := map[string]string{}
-    for _, part := range parts {
-      part_parts := strings.Split(part,"|")
-      //log.Printf("%s = %s",part_parts[0], part_parts[1])
-      result[part_parts[0]] = part_parts[1]
-    }
-    return result
-}
-
-func encodeMessage(message map[string]string) string {
-    result := ""
-    for key, value := range message {
-       if len(result) > 0 { result = result + "||" }
-        result = result + key + "|" + value
-    }
-    return result
-}
-
 func handleTCPConnection(c net.Conn) {
     defer c.Close()
     msg, err := ReadMessage(c)
@@ -140,40 +152,199 @@ func handleTCPConnection(c net.Conn) {
         log.Println("Invalid connection: failure reading id message")
         return
     }
-    message := decodeMessage(string(msg))
+    message, err := decodeMessage(msg, ProtocolLegacy)
+    if err != nil {
+        log.Println("Invalid connection: malformed id message:", err)
+        return
+    }
     id := message["source"]
     plugin:= message["plugin"]
-    mu.Lock()
-    connections[id] = &UIConnection{Conn: c, Id: id, Plugin: plugin, Info: GetAllParamInfo(plugin)}
-    mu.Unlock()
+    if id == "" {
+        log.Println("Invalid connection: no source in id message")
+        return
+    }
+    protocol := handshakeProtocol(message)
+    identity := identityHints(message)
+    conn := &UIConnection{Conn: c, Id: id, Plugin: plugin, Ordinal: identity.Ordinal, Protocol: protocol, Info: GetAllParamInfo(plugin), Reported: StateCache{}, pending: make(map[string]chan Message), Connected: time.Now()}
+    conn.touch()
+    conn.startWriter()
+    defer conn.shutdown()
+    registerWithAlias(conn, identity)
+    defer unregisterConnection(conn)
+    offerLastState(conn)
 
-    log.Println("UI connected:", id)
+    log.Println("UI connected:", id, c.RemoteAddr(), "protocol", protocol, "alias", conn.Alias)
 
     for {
-        ReadMessage(c)
-/*
-        line, err := reader.ReadString('\n')
+        msg, err := ReadMessage(c)
         if err != nil {
-            log.Println("UI disconnected:", id)
-            mu.Lock()
-            delete(connections, id)
-            mu.Unlock()
+            if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+                log.Println("UI disconnected:", id)
+            } else {
+                log.Println("UI connection lost:", id, err)
+            }
             return
         }
-        line = strings.TrimSpace(line)
-
-        mu.Lock()
-        connections[id].Messages = append(connections[id].Messages, line)
-        if len(connections[id].Messages) > 50 { // keep last 50
-            connections[id].Messages = connections[id].Messages[len(connections[id].Messages)-50:]
+        conn.received.Add(1)
+        conn.touch()
+        message, err := decodeMessage(msg, conn.Protocol)
+        if err != nil {
+            log.Printf("Ignoring malformed message from %s: %v", id, err)
+            continue
         }
-        mu.Unlock()
+        handleUIMessage(conn, message)
+    }
+}
+
+// Add a connection to the registry. A previous connection with the same id
+// is closed, which makes its read loop terminate.
+func registerConnection(conn *UIConnection) {
+    mu.Lock()
+    old := connections[conn.Id]
+    connections[conn.Id] = conn
+    mu.Unlock()
+    if old != nil {
+        log.Println("UI reconnected, replacing old connection:", conn.Id)
+        old.Conn.Close()
+    }
+}
+
+// Remove a connection from the registry unless it has already been
+// replaced by a newer connection with the same id. State of a connection
+// without alias can't be found again and is dropped.
+func unregisterConnection(conn *UIConnection) {
+    rememberState(conn)
+    mu.Lock()
+    current := connections[conn.Id] == conn
+    if current {
+        delete(connections, conn.Id)
+    }
+    mu.Unlock()
+    if current && conn.Alias == "" {
+        dropHistory(conn.Id)
+        dropFeed(conn.Id)
+    }
+    withdrawRestoreOffer(conn)
+}
+
+// Store a parameter value reported by the UI in the connection state cache.
+// Reports carry type, key, kind and value, e.g.
+// {"source":"<id>","type":"control","key":"3","kind":"float","value":"0.5"}
+// A message carrying "request" is the reply to a command sent with that id.
+func handleUIMessage(conn *UIConnection, message Message) {
+    if request := message["request"]; request != "" {
+        defer conn.resolve(request, message)
+    }
+    typ := message["type"]
+    key := message["key"]
+    if typ == "" || key == "" {
+        log.Printf("Ignoring message from %s: %v", conn.Id, message)
+        return
+    }
+    value, err := ParseStateValue(message["kind"], message["value"])
+    if err != nil {
+        log.Printf("Ignoring %s %s from %s: %v", typ, key, conn.Id, err)
+        return
+    }
+    mu.Lock()
+    conn.Reported[StateKey{Type: typ, Key: key}] = value
+    mu.Unlock()
+    Publish(conn.Id, StateKey{Type: typ, Key: key}, value)
+    compareLastState(conn, false)
+}
+
+
+var (
+    ErrNoConnection = errors.New("no such connection")
+    ErrTimeout      = errors.New("no reply from plugin UI")
+)
+
+// Encode a message in the protocol version of the connection and queue it
+// for the writer, failing with ErrQueueFull if the queue is full. Messages
+// without an id are given one. Returns the encoded message.
+func (conn *UIConnection) Send(message Message) ([]byte, error) {
+    return conn.send(message, false)
+}
+
+func (conn *UIConnection) send(message Message, wait bool) ([]byte, error) {
+    if message["id"] == "" {
+       message["id"] = strconv.FormatUint(conn.requests.Add(1), 10)
+    }
+    payload, err := encodeMessage(message, conn.Protocol)
+    if err != nil {
+       return nil, err
+    }
+    if err := conn.write(payload, wait); err != nil {
+       return nil, err
+    }
+    return payload, nil
+}
+
+// Send a command and wait for the reply echoing its id. Fails with
+// ErrNoConnection if the connection ends before the reply arrives.
+func (conn *UIConnection) Request(message Message, timeout time.Duration) (Message, error) {
+    id := strconv.FormatUint(conn.requests.Add(1), 10)
+    message["id"] = id
+    reply := make(chan Message, 1)
+    mu.Lock()
+    conn.pending[id] = reply
+    mu.Unlock()
+    defer func() {
+       mu.Lock()
+       delete(conn.pending, id)
+       mu.Unlock()
+    }()
+
+    if _, err := conn.Send(message); err != nil {
+       return nil, err
+    }
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    select {
+    case m := <-reply:
+       return m, nil
+    case <-timer.C:
+       return nil, ErrTimeout
+    case <-conn.done:
+       return nil, ErrNoConnection
+    }
+}
+
+// Hand a reply to the request waiting for it, if any.
+func (conn *UIConnection) resolve(id string, message Message) {
+    mu.Lock()
+    reply, ok := conn.pending[id]
+    delete(conn.pending, id)
+    mu.Unlock()
+    if ok {
+       reply <- message
+    }
+}
 
-        log.Printf("From %s: %s", id, line)
-*/
+// Set command for a parameter, patch values carry their atom kind.
+func (conn *UIConnection) setMessage(typ, key, value string) Message {
+    message := Message{"cmd": "set", "type": typ, "key": key, "value": value}
+    if param, ok := conn.Info.Param(typ, key); ok && typ == "patch" {
+       message["kind"] = RangeKind(param.Range)
     }
+    return message
 }
 
+// Send a set command for one parameter to the UI of a connection.
+// Returns the command sent.
+func SetParameter(context, typ, key, value string) (string, error) {
+    mu.Lock()
+    conn, ok := connections[context]
+    mu.Unlock()
+    if !ok {
+       return "", ErrNoConnection
+    }
+    cmd, err := conn.queueSet(conn.setMessage(typ, key, value))
+    if err != nil {
+       return "", err
+    }
+    return string(cmd), nil
+}
 
 func madiganParameterHandler(w http.ResponseWriter, r *http.Request) {
     context := r.URL.Query().Get("context")
@@ -182,7 +353,6 @@ func madiganParameterHandler(w http.ResponseWriter, r *http.Request) {
     value := r.URL.Query().Get("value")
     switch r.Method {
        case http.MethodGet:
-          cmd := fmt.Sprintf("cmd|get||type|%s||key|%s", typ, key)
           mu.Lock()
           conn, ok := connections[context]
           if !ok {
@@ -190,29 +360,49 @@ func madiganParameterHandler(w http.ResponseWriter, r *http.Request) {
              http.Error(w, "No such connection", 404)
              return
           }
-          globalkey := typ+key
-          fmt.Printf("\nglobalkey %s",globalkey)
-          reported, ok := conn.Reported[globalkey] 
+          reported, ok := conn.Reported[StateKey{Type: typ, Key: key}]
           mu.Unlock()
-          if !ok {
-             fmt.Printf("\nSending cmd %s   to %v",cmd, conn)
-             if err := SendMessage(conn.Conn, []byte(cmd)); err != nil {
-                http.Error(w, "Send failed", 500)
+          if !ok && conn.Protocol < ProtocolJSON {
+             // Legacy UIs don't echo the request id, ask for the value and
+             // answer with what is known now, a later GET will find it.
+             if _, err := conn.Send(Message{"cmd": "get", "type": typ, "key": key}); err != nil {
+                http.Error(w, "Send failed: " + err.Error(), sendErrorStatus(err))
+                return
+             }
+          } else if !ok {
+             reply, err := conn.Request(Message{"cmd": "get", "type": typ, "key": key}, getTimeout)
+             if errors.Is(err, ErrTimeout) {
+                http.Error(w, "Plugin did not reply", http.StatusGatewayTimeout)
+                return
+             }
+             if err != nil {
+                http.Error(w, "Send failed: " + err.Error(), sendErrorStatus(err))
+                return
+             }
+             if reply["error"] != "" {
+                http.Error(w, reply["error"], 404)
+                return
+             }
+             reported, err = ParseStateValue(reply["kind"], reply["value"])
+             if err != nil {
+                http.Error(w, err.Error(), http.StatusBadGateway)
                 return
              }
           }
           fmt.Fprintf(w, "%s", reported)
        case http.MethodPatch:
-          cmd := fmt.Sprintf("cmd|set||type|%s||key|%s||value|%s", typ, key, value)
-          mu.Lock()
-          conn, ok := connections[context]
-          mu.Unlock()
-          if !ok {
+          cmd, err := EditParameter(context, Setting{Type: typ, Key: key, Value: value})
+          var verr *ValidationError
+          if errors.As(err, &verr) {
+             writeValidationError(w, verr)
+             return
+          }
+          if errors.Is(err, ErrNoConnection) {
              http.Error(w, "No such connection", 404)
              return
           }
-          if err := SendMessage(conn.Conn, []byte(cmd)); err != nil {
-             http.Error(w, "Send failed", 500)
+          if err != nil {
+             http.Error(w, "Send failed: " + err.Error(), sendErrorStatus(err))
              return
           }
           fmt.Fprintf(w, "Sent to %s: %s", context, cmd)
@@ -223,7 +413,5 @@ func madiganParameterHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func init() {
-    go tcpHandler()
-
     http.HandleFunc("/madigan-parameter", madiganParameterHandler)
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Plugin UI end of a registered connection
+type testUI struct {
+	conn *UIConnection
+	peer net.Conn
+}
+
+func connectTestUI(t *testing.T, id string, protocol int, info AllInfo) *testUI {
+	t.Helper()
+	server, client := net.Pipe()
+	conn := &UIConnection{Conn: server, Id: id, Plugin: "urn:test", Protocol: protocol, Info: info, Reported: StateCache{}, pending: make(map[string]chan Message), Connected: time.Now()}
+	conn.touch()
+	conn.startWriter()
+	registerConnection(conn)
+	t.Cleanup(func() {
+		conn.shutdown()
+		unregisterConnection(conn)
+		server.Close()
+		client.Close()
+	})
+	return &testUI{conn: conn, peer: client}
+}
+
+// Next message written to the UI.
+func (ui *testUI) next(t *testing.T) Message {
+	t.Helper()
+	ui.peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := ReadMessage(ui.peer)
+	if err != nil {
+		t.Fatal("reading from connection:", err)
+	}
+	message, err := decodeMessage(data, ui.conn.Protocol)
+	if err != nil {
+		t.Fatal("decoding message:", err)
+	}
+	return message
+}
+
+// Report values to the server as the UI would.
+func (ui *testUI) report(values map[string]string) {
+	for key, value := range values {
+		typ := "control"
+		if key == "urn:test#cutoff" {
+			typ = "patch"
+		}
+		handleUIMessage(ui.conn, Message{"type": typ, "key": key, "kind": KindFloat, "value": value})
+	}
+}
+
+// Metadata of a test plugin: control input 1 (0..1, default 0.25), an
+// output port 2, and a float patch parameter.
+func testInfo() AllInfo {
+	return AllInfo{
+		ControlInput: []Info{
+			{Index: "1", Symbol: "gain", Input: true, Control: true, Min: 0, Max: 1, Default: 0.25},
+			{Index: "2", Symbol: "level", Output: true, Control: true, Min: 0, Max: 1},
+		},
+		PatchParameter: []Info{
+			{Uri: "urn:test#cutoff", Range: "http://lv2plug.in/ns/ext/atom#Float", Min: 20, Max: 20000},
+		},
+	}
+}
+
+func TestRequestEndsWithConnection(t *testing.T) {
+	ui := connectTestUI(t, "writer-request", ProtocolJSON, testInfo())
+	result := make(chan error, 1)
+	go func() {
+		_, err := ui.conn.Request(Message{"cmd": "get", "type": "control", "key": "1"}, time.Hour)
+		result <- err
+	}()
+	ui.next(t)
+	ui.conn.shutdown()
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrNoConnection) {
+			t.Fatalf("expected %v, got %v", ErrNoConnection, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("request should end with the connection")
+	}
+}
+
+// Open a connection to handleTCPConnection and send the id message. The
+// returned channel is closed when the handler returns.
+func dialTestUI(t *testing.T, handshake string) (net.Conn, chan struct{}) {
+	t.Helper()
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleTCPConnection(server)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	if err := SendMessage(client, []byte(handshake)); err != nil {
+		t.Fatal(err)
+	}
+	return client, done
+}
+
+// Wait until the registered connection for id satisfies ok.
+func waitConnection(t *testing.T, id string, ok func(*UIConnection) bool) *UIConnection {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		conn := connections[id]
+		mu.Unlock()
+		if ok(conn) {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection %s: timed out, registered %v", id, conn)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func getParameter(context, typ, key string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	madiganParameterHandler(w, httptest.NewRequest(http.MethodGet, "/madigan-parameter?context="+context+"&type="+typ+"&key="+key, nil))
+	return w
+}
+
+func TestReportsAreCached(t *testing.T) {
+	tests := []struct {
+		handshake string
+		reports   []string
+	}{
+		{"source|cache-legacy||plugin|urn:test", []string{
+			"source|cache-legacy||type|control||key|1||kind|float||value|0.5",
+			"source|cache-legacy||type|patch||key|urn:test#cutoff||kind|float||value|440",
+		}},
+		{"source|cache-json||plugin|urn:test||protocol|2", []string{
+			`{"source":"cache-json","type":"control","key":"1","kind":"float","value":"0.5"}`,
+			`{"source":"cache-json","type":"patch","key":"urn:test#cutoff","kind":"float","value":440}`,
+		}},
+	}
+	for _, test := range tests {
+		client, _ := dialTestUI(t, test.handshake)
+		id := strings.TrimPrefix(strings.Split(test.handshake, "||")[0], "source|")
+		for _, report := range append([]string{"malformed", "type|control||key|1||kind|float||value|oops"}, test.reports...) {
+			if err := SendMessage(client, []byte(report)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitConnection(t, id, func(conn *UIConnection) bool {
+			state, _ := ConnectionState(id)
+			return len(state) == 2
+		})
+		if w := getParameter(id, "control", "1"); w.Code != http.StatusOK || w.Body.String() != "0.5" {
+			t.Errorf("%s control 1: got %d %q", id, w.Code, w.Body)
+		}
+		if w := getParameter(id, "patch", "urn:test%23cutoff"); w.Code != http.StatusOK || w.Body.String() != "440" {
+			t.Errorf("%s cutoff: got %d %q", id, w.Code, w.Body)
+		}
+	}
+	if w := getParameter("cache-none", "control", "1"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown context: got %d", w.Code)
+	}
+}
+
+func TestDisconnectUnregisters(t *testing.T) {
+	first, firstDone := dialTestUI(t, "source|disconnect-ui||plugin|urn:test")
+	old := waitConnection(t, "disconnect-ui", func(conn *UIConnection) bool { return conn != nil })
+
+	// A reconnect with the same source replaces and closes the old connection
+	second, secondDone := dialTestUI(t, "source|disconnect-ui||plugin|urn:test")
+	waitConnection(t, "disconnect-ui", func(conn *UIConnection) bool { return conn != nil && conn != old })
+	select {
+	case <-firstDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("replaced connection should end")
+	}
+	if _, err := first.Write([]byte{0}); err == nil {
+		t.Error("replaced connection should be closed")
+	}
+	// The old connection ending must not unregister its replacement
+	waitConnection(t, "disconnect-ui", func(conn *UIConnection) bool { return conn != nil && conn != old })
+
+	second.Close()
+	select {
+	case <-secondDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection should end when the UI goes away")
+	}
+	waitConnection(t, "disconnect-ui", func(conn *UIConnection) bool { return conn == nil })
+}
@@ -0,0 +1,207 @@
+// =====================================================================================================
+// File:           outbox.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Rate limited queue of set commands and gesture markers toward a plugin UI
+// =====================================================================================================
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+type outboxItem struct {
+	key     StateKey
+	message Message
+	set     bool // A set command
+	batch   bool // A batch of set commands, nothing is coalesced across it
+}
+
+// Outbox holds commands not yet sent to a plugin UI. Pending sets of the
+// same parameter are coalesced so only the latest value is sent, and sets
+// and batches are sent at most setRate per second. Gesture markers keep
+// their place in the queue and are not rate limited. At most outboxLen
+// commands wait, further ones fail with ErrQueueFull.
+type Outbox struct {
+	mu      sync.Mutex
+	items   []outboxItem
+	running bool // A flushOutbox goroutine is draining the queue
+}
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+// Queue a message, replacing a pending set of the same parameter unless a
+// gesture marker for it was queued after that set. Fails with ErrQueueFull
+// if the message would not fit.
+func (conn *UIConnection) enqueue(item outboxItem) error {
+	box := &conn.outbox
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	queued := false
+	if item.set {
+		for i := len(box.items) - 1; i >= 0; i-- {
+			if box.items[i].batch {
+				break
+			}
+			if box.items[i].key != item.key {
+				continue
+			}
+			if box.items[i].set {
+				box.items[i] = item
+				queued = true
+			}
+			break
+		}
+	}
+	if !queued {
+		if int64(len(box.items)) >= outboxLen {
+			return ErrQueueFull
+		}
+		box.items = append(box.items, item)
+	}
+	if !box.running {
+		box.running = true
+		go conn.flushOutbox()
+	}
+	return nil
+}
+
+func (conn *UIConnection) flushOutbox() {
+	box := &conn.outbox
+	interval := time.Duration(float64(time.Second) / setRate)
+	for {
+		box.mu.Lock()
+		if len(box.items) == 0 {
+			box.running = false
+			box.mu.Unlock()
+			return
+		}
+		item := box.items[0]
+		box.items = box.items[1:]
+		box.mu.Unlock()
+
+		// Wait for room in the write queue, the outbox is already rate limited
+		if _, err := conn.send(item.message, true); err != nil {
+			log.Printf("Send to %s failed, dropping queued commands: %v", conn.Id, err)
+			box.mu.Lock()
+			box.items = nil
+			box.running = false
+			box.mu.Unlock()
+			return
+		}
+		if item.set || item.batch {
+			time.Sleep(interval)
+		}
+	}
+}
+
+// Queue a set command. The returned payload is the message as it will be sent.
+func (conn *UIConnection) queueSet(message Message) ([]byte, error) {
+	if conn.closed() {
+		return nil, ErrPeerGone
+	}
+	message["id"] = strconv.FormatUint(conn.requests.Add(1), 10)
+	payload, err := encodeMessage(message, conn.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.enqueue(outboxItem{key: StateKey{Type: message["type"], Key: message["key"]}, message: message, set: true}); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Queue a batch of set commands sent as one message.
+func (conn *UIConnection) queueBatch(message Message) ([]byte, error) {
+	if conn.closed() {
+		return nil, ErrPeerGone
+	}
+	message["id"] = strconv.FormatUint(conn.requests.Add(1), 10)
+	payload, err := encodeMessage(message, conn.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.enqueue(outboxItem{message: message, batch: true}); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Gesture queues a begin or end marker for an interactive change of a
+// parameter, which the UI forwards to the host as ui:touch. UIs speaking
+// protocol version 1 do not know the marker and are not sent it.
+func Gesture(context string, typ string, key string, begin bool) error {
+	mu.Lock()
+	conn, ok := connections[context]
+	mu.Unlock()
+	if !ok {
+		return ErrNoConnection
+	}
+	if conn.Protocol < ProtocolJSON {
+		return nil
+	}
+	grabbed := "0"
+	if begin {
+		grabbed = "1"
+	}
+	message := Message{"cmd": "touch", "type": typ, "key": key, "value": grabbed}
+	message["id"] = strconv.FormatUint(conn.requests.Add(1), 10)
+	return conn.enqueue(outboxItem{key: StateKey{Type: typ, Key: key}, message: message})
+}
+
+// =====================================================================================================
+// gestureHandler
+// =====================================================================================================
+
+// POST /madigan-parameter/gesture?context=&type=&key=&state=begin|end
+func gestureHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	context := r.URL.Query().Get("context")
+	typ := r.URL.Query().Get("type")
+	key := r.URL.Query().Get("key")
+	state := r.URL.Query().Get("state")
+	if context == "" || typ == "" || key == "" {
+		http.Error(w, "Missing 'context', 'type' or 'key' parameter", 400)
+		return
+	}
+	if state != "begin" && state != "end" {
+		http.Error(w, fmt.Sprintf("Invalid state %q, expected begin or end", state), 400)
+		return
+	}
+	err := Gesture(context, typ, key, state == "begin")
+	if errors.Is(err, ErrNoConnection) {
+		http.Error(w, "No such connection", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Send failed: "+err.Error(), sendErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	http.HandleFunc("/madigan-parameter/gesture", gestureHandler)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// Connection whose outbox is inspected rather than flushed
+func heldOutbox() *UIConnection {
+	conn := &UIConnection{Id: "outbox", Protocol: ProtocolJSON, done: make(chan struct{})}
+	conn.outbox.running = true
+	return conn
+}
+
+func queuedValues(conn *UIConnection) []string {
+	var values []string
+	for _, item := range conn.outbox.items {
+		switch {
+		case item.batch:
+			values = append(values, "batch")
+		case item.set:
+			values = append(values, item.key.Key+"="+item.message["value"])
+		default:
+			values = append(values, item.key.Key+":"+item.message["value"])
+		}
+	}
+	return values
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOutboxCoalescesSets(t *testing.T) {
+	conn := heldOutbox()
+	conn.queueSet(conn.setMessage("control", "1", "0.1"))
+	conn.queueSet(conn.setMessage("control", "2", "0.5"))
+	conn.queueSet(conn.setMessage("control", "1", "0.2"))
+	conn.queueSet(conn.setMessage("control", "1", "0.3"))
+
+	if got, want := queuedValues(conn), []string{"1=0.3", "2=0.5"}; !equalValues(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestOutboxKeepsSetsAcrossMarkersAndBatches(t *testing.T) {
+	conn := heldOutbox()
+	conn.queueSet(conn.setMessage("control", "1", "0.1"))
+	conn.enqueue(outboxItem{key: StateKey{Type: "control", Key: "1"}, message: Message{"cmd": "touch", "value": "0"}})
+	conn.queueSet(conn.setMessage("control", "1", "0.2"))
+	conn.queueBatch(Message{"cmd": "batch", "items": "[]"})
+	conn.queueSet(conn.setMessage("control", "1", "0.3"))
+	conn.queueSet(conn.setMessage("control", "1", "0.4"))
+
+	want := []string{"1=0.1", "1:0", "1=0.2", "batch", "1=0.4"}
+	if got := queuedValues(conn); !equalValues(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestOutboxBound(t *testing.T) {
+	defer func(saved int64) { outboxLen = saved }(outboxLen)
+	outboxLen = 2
+
+	conn := heldOutbox()
+	for _, key := range []string{"1", "2"} {
+		if _, err := conn.queueSet(conn.setMessage("control", key, "0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := conn.queueSet(conn.setMessage("control", "3", "0")); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	if _, err := conn.queueBatch(Message{"cmd": "batch", "items": "[]"}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull for a batch, got %v", err)
+	}
+	// Replacing a pending set needs no room
+	if _, err := conn.queueSet(conn.setMessage("control", "1", "1")); err != nil {
+		t.Fatalf("coalesced set failed: %v", err)
+	}
+}
+
+func TestOutboxClosed(t *testing.T) {
+	conn := heldOutbox()
+	conn.shutdown()
+	if _, err := conn.queueSet(conn.setMessage("control", "1", "0")); !errors.Is(err, ErrPeerGone) {
+		t.Fatalf("expected ErrPeerGone, got %v", err)
+	}
+}
+
+func TestOutboxFlush(t *testing.T) {
+	ui := connectTestUI(t, "outbox-flush", ProtocolJSON, testInfo())
+	if _, err := SetParameter("outbox-flush", "control", "1", "0.5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Gesture("outbox-flush", "control", "1", true); err != nil {
+		t.Fatal(err)
+	}
+	set := ui.next(t)
+	if set["cmd"] != "set" || set["key"] != "1" || set["value"] != "0.5" || set["id"] == "" {
+		t.Fatalf("unexpected set %v", set)
+	}
+	if touch := ui.next(t); touch["cmd"] != "touch" || touch["value"] != "1" {
+		t.Fatalf("unexpected marker %v", touch)
+	}
+}
+
+func TestGestureLegacy(t *testing.T) {
+	ui := connectTestUI(t, "outbox-legacy", ProtocolLegacy, testInfo())
+	if err := Gesture("outbox-legacy", "control", "1", true); err != nil {
+		t.Fatal(err)
+	}
+	SetParameter("outbox-legacy", "control", "1", "0.5")
+	// The marker is not sent to a legacy UI, the set is the first message
+	if m := ui.next(t); m["cmd"] != "set" {
+		t.Fatalf("expected set, got %v", m)
+	}
+}
@@ -7,6 +7,9 @@ import (
         "encoding/json"
         "fmt"
         "net/http"
+        "sort"
+        "strconv"
+        "strings"
 	"unsafe"
 )
 
@@ -36,6 +39,17 @@ type Info struct {
 	Midicc  string  `json:"midicc,omitempty"`
 
 	Range  string `json:"range"`
+
+	Unit        string `json:"unit,omitempty"`
+	Integer     bool   `json:"integer,omitempty"`
+	Logarithmic bool   `json:"logarithmic,omitempty"`
+	RangeSteps  int    `json:"rangeSteps,omitempty"`
+	Trigger     bool   `json:"trigger,omitempty"`
+	NotOnGUI    bool   `json:"notOnGUI,omitempty"`
+	Expensive   bool   `json:"expensive,omitempty"`
+	SampleRate  bool   `json:"sampleRate,omitempty"`
+
+	FileTypes []string `json:"fileTypes,omitempty"`
 }
 
 type AllInfo struct {
@@ -44,6 +58,42 @@ type AllInfo struct {
        PatchParameter []Info  `json:"patch"`
 }
 
+// Param looks up the metadata of a parameter by endpoint type and key.
+func (all AllInfo) Param(typ, key string) (Info, bool) {
+	switch typ {
+	case "control":
+		for _, info := range all.ControlInput {
+			if info.Index == key {
+				return info, true
+			}
+		}
+	case "midicc":
+		for _, info := range all.MidiParameter {
+			if info.Midicc == key {
+				return info, true
+			}
+		}
+	case "patch":
+		for _, info := range all.PatchParameter {
+			if info.Uri == key {
+				return info, true
+			}
+		}
+	}
+	return Info{}, false
+}
+
+// Settable tells whether a parameter is one a client sets: a control input
+// port, a MIDI CC parameter or a writable patch parameter. The control list
+// also holds output and audio ports.
+func (all AllInfo) Settable(typ, key string) bool {
+	info, ok := all.Param(typ, key)
+	if typ == "control" {
+		return ok && info.Input && info.Control
+	}
+	return ok
+}
+
 func paraminfo(plugin *C.LilvPlugin, world *C.LilvWorld) AllInfo {
         ports := PortsInfo(plugin, world)
 
@@ -55,14 +105,143 @@ func paraminfo(plugin *C.LilvPlugin, world *C.LilvWorld) AllInfo {
 }
 
 
+// Symbol of a units:unit value, e.g. "dB". Units without a symbol are
+// named by the fragment of their URI.
+func unitSymbol(world *C.LilvWorld, unit *C.LilvNode) string {
+	symbolPred := newUri(world, "http://lv2plug.in/ns/extensions/units#symbol")
+	defer C.lilv_node_free(symbolPred)
+	if symbol := C.lilv_world_get(world, unit, symbolPred, nil); symbol != nil {
+		defer C.lilv_node_free(symbol)
+		return nodeString(symbol)
+	}
+	if C.lilv_node_is_uri(unit) == true {
+		uri := nodeString(unit)
+		return uri[strings.LastIndex(uri, "#")+1:]
+	}
+	return ""
+}
+
+// Port properties and units shared by control ports and parameters
+type propertyNodes struct {
+	integer     *C.LilvNode
+	logarithmic *C.LilvNode
+	trigger     *C.LilvNode
+	notOnGUI    *C.LilvNode
+	expensive   *C.LilvNode
+	sampleRate  *C.LilvNode
+	rangeSteps  *C.LilvNode
+	unit        *C.LilvNode
+}
+
+func newPropertyNodes(world *C.LilvWorld) propertyNodes {
+	return propertyNodes{
+		integer:     newUri(world, "http://lv2plug.in/ns/lv2core#integer"),
+		logarithmic: newUri(world, "http://lv2plug.in/ns/ext/port-props#logarithmic"),
+		trigger:     newUri(world, "http://lv2plug.in/ns/ext/port-props#trigger"),
+		notOnGUI:    newUri(world, "http://lv2plug.in/ns/ext/port-props#notOnGUI"),
+		expensive:   newUri(world, "http://lv2plug.in/ns/ext/port-props#expensive"),
+		sampleRate:  newUri(world, "http://lv2plug.in/ns/lv2core#sampleRate"),
+		rangeSteps:  newUri(world, "http://lv2plug.in/ns/ext/port-props#rangeSteps"),
+		unit:        newUri(world, "http://lv2plug.in/ns/extensions/units#unit"),
+	}
+}
+
+func (n propertyNodes) free() {
+	C.lilv_node_free(n.integer)
+	C.lilv_node_free(n.logarithmic)
+	C.lilv_node_free(n.trigger)
+	C.lilv_node_free(n.notOnGUI)
+	C.lilv_node_free(n.expensive)
+	C.lilv_node_free(n.sampleRate)
+	C.lilv_node_free(n.rangeSteps)
+	C.lilv_node_free(n.unit)
+}
+
+// Read the properties of a parameter (MIDI or patch) described as a subject
+// in the world.
+func (n propertyNodes) readParam(world *C.LilvWorld, subject *C.LilvNode, portProperty *C.LilvNode, info *Info) {
+	has := func(prop *C.LilvNode) bool {
+		return C.lilv_world_ask(world, subject, portProperty, prop) == true
+	}
+	info.Integer = has(n.integer)
+	info.Logarithmic = has(n.logarithmic)
+	info.Trigger = has(n.trigger)
+	info.NotOnGUI = has(n.notOnGUI)
+	info.Expensive = has(n.expensive)
+	info.SampleRate = has(n.sampleRate)
+	if steps := C.lilv_world_get(world, subject, n.rangeSteps, nil); steps != nil {
+		info.RangeSteps = int(C.lilv_node_as_int(steps))
+		C.lilv_node_free(steps)
+	}
+	if unit := C.lilv_world_get(world, subject, n.unit, nil); unit != nil {
+		info.Unit = unitSymbol(world, unit)
+		C.lilv_node_free(unit)
+	}
+}
+
+// Scale points of a port, MIDI parameter or patch parameter, sorted by
+// value. lilv returns the rdfs:label literals matching the language of LANG
+// first, so labels with language tags come out localised.
+func scalePoints(world *C.LilvWorld, subject *C.LilvNode) []Point {
+	if subject == nil {
+		return nil
+	}
+	scalePoint := newUri(world, "http://lv2plug.in/ns/lv2core#scalePoint")
+	rdfValue := newUri(world, "http://www.w3.org/1999/02/22-rdf-syntax-ns#value")
+	rdfsLabel := newUri(world, "http://www.w3.org/2000/01/rdf-schema#label")
+	defer func() {
+		C.lilv_node_free(scalePoint)
+		C.lilv_node_free(rdfValue)
+		C.lilv_node_free(rdfsLabel)
+	}()
+
+	var points []Point
+	nodes := C.lilv_world_find_nodes(world, subject, scalePoint, nil)
+	if nodes == nil {
+		return nil
+	}
+	defer C.lilv_nodes_free(nodes)
+	for i := C.lilv_nodes_begin(nodes); !C.lilv_nodes_is_end(nodes, i) == true; i = C.lilv_nodes_next(nodes, i) {
+		sp := C.lilv_nodes_get(nodes, i)
+		value := C.lilv_world_get(world, sp, rdfValue, nil)
+		if value == nil {
+			continue
+		}
+		point := Point{Value: float32(C.lilv_node_as_float(value))}
+		C.lilv_node_free(value)
+		if labels := C.lilv_world_find_nodes(world, sp, rdfsLabel, nil); labels != nil {
+			if C.lilv_nodes_size(labels) > 0 {
+				point.Label = nodeString(C.lilv_nodes_get_first(labels))
+			}
+			C.lilv_nodes_free(labels)
+		}
+		if point.Label == "" {
+			point.Label = strconv.FormatFloat(float64(point.Value), 'g', -1, 32)
+		}
+		points = append(points, point)
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Value < points[j].Value })
+	return points
+}
+
+// Completes the enumeration model shared by ports and parameters. Toggles
+// without scale points get Off/On.
+func finishEnumeration(info *Info) {
+	if info.Toggle && len(info.Scale) == 0 {
+		info.Scale = []Point{Point{Label: "Off", Value: 0}, Point{Label: "On", Value: 1}}
+	}
+}
+
 func PortsInfo(plugin *C.LilvPlugin, world *C.LilvWorld) []Info {
 	var ports []Info
 
 	toggle := C.lilv_new_uri(world, C.CString("http://lv2plug.in/ns/lv2core#toggled"))
 	enum := C.lilv_new_uri(world, C.CString("http://lv2plug.in/ns/lv2core#enumeration"))
+	props := newPropertyNodes(world)
 	defer func() {
 		C.lilv_node_free(toggle)
 		C.lilv_node_free(enum)
+		props.free()
 	}()
 
 	numPorts := uint(C.lilv_plugin_get_num_ports(plugin))
@@ -129,29 +308,29 @@ func PortsInfo(plugin *C.LilvPlugin, world *C.LilvWorld) []Info {
 			}
 
 		       info.Toggle = C.lilv_port_has_property(plugin, port, toggle) == true
-                       if info.Toggle {
-                         info.Scale = []Point{Point{Label: "Off", Value: 0}, Point{Label: "On", Value: 1}}
-                       }
-		       info.Enum = C.lilv_port_has_property(plugin, port, toggle) == true
-
-
+		       info.Enum = C.lilv_port_has_property(plugin, port, enum) == true
+
+			info.Integer = C.lilv_port_has_property(plugin, port, props.integer) == true
+			info.Logarithmic = C.lilv_port_has_property(plugin, port, props.logarithmic) == true
+			info.Trigger = C.lilv_port_has_property(plugin, port, props.trigger) == true
+			info.NotOnGUI = C.lilv_port_has_property(plugin, port, props.notOnGUI) == true
+			info.Expensive = C.lilv_port_has_property(plugin, port, props.expensive) == true
+			info.SampleRate = C.lilv_port_has_property(plugin, port, props.sampleRate) == true
+			if steps := C.lilv_port_get(plugin, port, props.rangeSteps); steps != nil {
+				info.RangeSteps = int(C.lilv_node_as_int(steps))
+				C.lilv_node_free(steps)
+			}
+			if unit := C.lilv_port_get(plugin, port, props.unit); unit != nil {
+				info.Unit = unitSymbol(world, unit)
+				C.lilv_node_free(unit)
+			}
 		}
 
 		// Scale points
-		scalePoints := C.lilv_port_get_scale_points(plugin, port)
-		if scalePoints != nil {
-			var scaleList []Point
-			for i := C.lilv_scale_points_begin(scalePoints); !C.lilv_scale_points_is_end(scalePoints, i) == true; i = C.lilv_scale_points_next(scalePoints, i) {
-				sp := C.lilv_scale_points_get(scalePoints, i)
-				label := C.lilv_scale_point_get_label(sp)
-				value := C.lilv_scale_point_get_value(sp)
-
-				scaleList = append(scaleList, Point{Label: C.GoString(C.lilv_node_as_string(label)), Value: float32(C.lilv_node_as_float(value)),
-				})
-			}
-			C.lilv_scale_points_free(scalePoints)
-			info.Scale = scaleList
+		if scale := scalePoints(world, C.lilv_port_get_node(plugin, port)); len(scale) > 0 {
+			info.Scale = scale
 		}
+		finishEnumeration(&info)
 
 		ports = append(ports, info)
 	}
@@ -172,12 +351,11 @@ func MidiInfo(plugin *C.LilvPlugin, world *C.LilvWorld) []Info {
 	portProperty := C.lilv_new_uri(world, C.CString("http://lv2plug.in/ns/lv2core#portProperty"))
 	toggle := C.lilv_new_uri(world, C.CString("http://lv2plug.in/ns/lv2core#toggled"))
 	enum := C.lilv_new_uri(world, C.CString("http://lv2plug.in/ns/lv2core#enumeration"))
-
-	scalePoint := C.lilv_new_uri(world, C.CString("http://lv2plug.in/ns/lv2core#scalePoint"))
-	rdfValue := C.lilv_new_uri(world, C.CString("http://www.w3.org/1999/02/22-rdf-syntax-ns#value"))
 	rdfsLabelPred := C.lilv_new_uri(world, C.CString("http://www.w3.org/2000/01/rdf-schema#label"))
+	props := newPropertyNodes(world)
 
 	defer func() {
+		props.free()
 		C.lilv_node_free(midiParams)
 		C.lilv_node_free(midiCC)
 		C.lilv_node_free(lv2default)
@@ -187,8 +365,6 @@ func MidiInfo(plugin *C.LilvPlugin, world *C.LilvWorld) []Info {
 		C.lilv_node_free(portProperty)
 		C.lilv_node_free(toggle)
 		C.lilv_node_free(enum)
-		C.lilv_node_free(scalePoint)
-		C.lilv_node_free(rdfValue)
 		C.lilv_node_free(rdfsLabelPred)
 	}()
 
@@ -227,25 +403,10 @@ func MidiInfo(plugin *C.LilvPlugin, world *C.LilvWorld) []Info {
 
 		info.Enum = C.lilv_world_ask(world, param, portProperty, enum) == true
 		info.Toggle = C.lilv_world_ask(world, param, portProperty, toggle) == true
+		props.readParam(world, param, portProperty, &info)
 
-		scaleNodes := C.lilv_world_find_nodes(world, param, scalePoint, nil)
-		var scales []Point
-		for j := C.lilv_nodes_begin(scaleNodes); !C.lilv_nodes_is_end(scaleNodes, j) == true; j = C.lilv_nodes_next(scaleNodes, j) {
-			sp := C.lilv_nodes_get(scaleNodes, j)
-			values := C.lilv_world_find_nodes(world, sp, rdfValue, nil)
-			labels := C.lilv_world_find_nodes(world, sp, rdfsLabelPred, nil)
-			if C.lilv_nodes_size(values) > 0 && C.lilv_nodes_size(labels) > 0 {
-				val := C.lilv_nodes_get_first(values)
-				lab := C.lilv_nodes_get_first(labels)
-				scales = append(scales, Point {
-					Label: C.GoString(C.lilv_node_as_string(lab)),
-					Value: float32(C.lilv_node_as_float(val)),
-				})
-				C.lilv_nodes_free(values)
-				C.lilv_nodes_free(labels)
-			}
-		}
-		info.Scale = scales
+		info.Scale = scalePoints(world, param)
+		finishEnumeration(&info)
 		result = append(result, info)
 	}
 
@@ -272,13 +433,16 @@ func ParamsInfo(plugin *C.LilvPlugin, world *C.LilvWorld) []Info {
 	portProperty := C.lilv_new_uri(world, C.CString("http://lv2plug.in/ns/lv2core#portProperty"))
 	rdfsRange := C.lilv_new_uri(world, C.CString("http://www.w3.org/2000/01/rdf-schema#range"))
 	rdfsLabel := C.lilv_new_uri(world, C.CString("http://www.w3.org/2000/01/rdf-schema#label"))
-	scalePoint := C.lilv_new_uri(world, C.CString("http://lv2plug.in/ns/lv2core#scalePoint"))
-	rdfValue := C.lilv_new_uri(world, C.CString("http://www.w3.org/1999/02/22-rdf-syntax-ns#value"))
-	rdfsLabelPred := C.lilv_new_uri(world, C.CString("http://www.w3.org/2000/01/rdf-schema#label"))
 	toggle := C.lilv_new_uri(world, C.CString("http://lv2plug.in/ns/lv2core#toggled"))
 	enum := C.lilv_new_uri(world, C.CString("http://lv2plug.in/ns/lv2core#enumeration"))
+	modFileTypes := newUri(world, "http://moddevices.com/ns/mod#fileTypes")
+	lv2FileTypes := newUri(world, "http://lv2plug.in/ns/lv2core#fileTypes")
+	props := newPropertyNodes(world)
 
 	defer func() {
+		props.free()
+		C.lilv_node_free(modFileTypes)
+		C.lilv_node_free(lv2FileTypes)
 		C.lilv_node_free(lv2default)
 		C.lilv_node_free(lv2min)
 		C.lilv_node_free(lv2max)
@@ -286,9 +450,6 @@ func ParamsInfo(plugin *C.LilvPlugin, world *C.LilvWorld) []Info {
 		C.lilv_node_free(portProperty)
 		C.lilv_node_free(rdfsRange)
 		C.lilv_node_free(rdfsLabel)
-		C.lilv_node_free(scalePoint)
-		C.lilv_node_free(rdfValue)
-		C.lilv_node_free(rdfsLabelPred)
 		C.lilv_node_free(toggle)
 		C.lilv_node_free(enum)
 	}()
@@ -312,6 +473,18 @@ func ParamsInfo(plugin *C.LilvPlugin, world *C.LilvWorld) []Info {
 			info.Name = C.GoString(C.lilv_node_as_string(labelNode))
 		}
 
+		// File types, e.g. mod:fileTypes "sf2,sf3"
+		for _, pred := range []*C.LilvNode{modFileTypes, lv2FileTypes} {
+			if types := C.lilv_world_get(world, node, pred, nil); types != nil {
+				for _, t := range strings.Split(nodeString(types), ",") {
+					if t = strings.TrimSpace(t); t != "" {
+						info.FileTypes = append(info.FileTypes, t)
+					}
+				}
+				C.lilv_node_free(types)
+			}
+		}
+
 		if val := C.lilv_world_get(world, node, lv2default, nil); val != nil {
 			info.Default = float32(C.lilv_node_as_float(val))
 		}
@@ -329,31 +502,10 @@ func ParamsInfo(plugin *C.LilvPlugin, world *C.LilvWorld) []Info {
 
 		info.Enum = C.lilv_world_ask(world, node, portProperty, enum) == true
 		info.Toggle = C.lilv_world_ask(world, node, portProperty, toggle) == true
+		props.readParam(world, node, portProperty, &info)
 
-		// Scale points
-		scaleNodes := C.lilv_world_find_nodes(world, node, scalePoint, nil)
-		var scales []Point
-
-		for j := C.lilv_nodes_begin(scaleNodes); !C.lilv_nodes_is_end(scaleNodes, j) == true; j = C.lilv_nodes_next(scaleNodes, j) {
-			bnode := C.lilv_nodes_get(scaleNodes, j)
-
-			vals := C.lilv_world_find_nodes(world, bnode, rdfValue, nil)
-			labels := C.lilv_world_find_nodes(world, bnode, rdfsLabelPred, nil)
-
-			if C.lilv_nodes_size(vals) > 0 && C.lilv_nodes_size(labels) > 0 {
-				value := C.lilv_nodes_get_first(vals)
-				label := C.lilv_nodes_get_first(labels)
-
-				scales = append(scales, Point {
-					Label: C.GoString(C.lilv_node_as_string(label)),
-					Value: float32(C.lilv_node_as_float(value)),
-				})
-
-				C.lilv_nodes_free(vals)
-				C.lilv_nodes_free(labels)
-			}
-		}
-		info.Scale = scales
+		info.Scale = scalePoints(world, node)
+		finishEnumeration(&info)
 		result = append(result, info)
 	}
 
@@ -361,38 +513,22 @@ func ParamsInfo(plugin *C.LilvPlugin, world *C.LilvWorld) []Info {
 }
 
 
+// Parameter metadata for a plugin, cached until the next rescan.
 func GetAllParamInfo(pluginUri string) AllInfo {
-
-	cURI := C.CString(pluginUri)
-	defer C.free(unsafe.Pointer(cURI))
-
-	world := C.lilv_world_new()
-	defer C.lilv_world_free(world)
-
-	C.lilv_world_load_all(world)
-
-	pluginUriNode := C.lilv_new_uri(world, cURI)
-	defer C.lilv_node_free(pluginUriNode)
-
-	plugins := C.lilv_world_get_all_plugins(world)
-
-	var plugin *C.LilvPlugin
-	for iter := C.lilv_plugins_begin(plugins); !C.lilv_plugins_is_end(plugins, iter); iter = C.lilv_plugins_next(plugins, iter) {
-		p := C.lilv_plugins_get(plugins, iter)
-		pURI := C.lilv_plugin_get_uri(p)
-
-		if C.GoString(C.lilv_node_as_uri(pURI)) == pluginUri {
-			plugin = p
-			break
+	var info AllInfo
+	WithWorld(func(world *C.LilvWorld) {
+		if cached, ok := paramCache[pluginUri]; ok {
+			info = cached
+			return
 		}
-	}
-
-	if plugin == nil {
-		return AllInfo{}
-	}
-
-    return paraminfo(plugin,world)
-
+		plugin := findPlugin(world, pluginUri)
+		if plugin == nil {
+			return
+		}
+		info = paraminfo(plugin, world)
+		paramCache[pluginUri] = info
+	})
+	return info
 }
 
 
@@ -0,0 +1,204 @@
+// =====================================================================================================
+// File:           plugins.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Web server service handler listing the installed LV2 plugins
+// =====================================================================================================
+
+package main
+
+// #cgo pkg-config: lilv-0
+// #include <lilv/lilv.h>
+// #include <stdlib.h>
+//
+// static uint32_t count_ports(const LilvPlugin* plugin, const LilvNode* direction, const LilvNode* type) {
+//     return lilv_plugin_get_num_ports_of_class(plugin, direction, type, NULL);
+// }
+import "C"
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+const madiganUiUri = "http://helander.network/lv2ui/madigan"
+
+type PortCounts struct {
+	AudioIn    int `json:"audioIn"`
+	AudioOut   int `json:"audioOut"`
+	ControlIn  int `json:"controlIn"`
+	ControlOut int `json:"controlOut"`
+	AtomIn     int `json:"atomIn"`
+	AtomOut    int `json:"atomOut"`
+}
+
+type PluginEntry struct {
+	Uri      string     `json:"uri"`
+	Name     string     `json:"name"`
+	Class    string     `json:"class"`
+	ClassUri string     `json:"classUri"`
+	Author   string     `json:"author,omitempty"`
+	Bundle   string     `json:"bundle"`
+	Ports    PortCounts `json:"ports"`
+	Madigan  bool       `json:"madigan"`
+}
+
+// =====================================================================================================
+// Local state
+// =====================================================================================================
+
+// Built on first use after each world load, guarded by lv2Mu
+var pluginCatalogue []PluginEntry
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+func newUri(world *C.LilvWorld, uri string) *C.LilvNode {
+	curi := C.CString(uri)
+	defer C.free(unsafe.Pointer(curi))
+	return C.lilv_new_uri(world, curi)
+}
+
+func nodeString(node *C.LilvNode) string {
+	if node == nil {
+		return ""
+	}
+	return C.GoString(C.lilv_node_as_string(node))
+}
+
+func buildCatalogue(world *C.LilvWorld) []PluginEntry {
+	input := newUri(world, "http://lv2plug.in/ns/lv2core#InputPort")
+	output := newUri(world, "http://lv2plug.in/ns/lv2core#OutputPort")
+	audio := newUri(world, "http://lv2plug.in/ns/lv2core#AudioPort")
+	control := newUri(world, "http://lv2plug.in/ns/lv2core#ControlPort")
+	atom := newUri(world, "http://lv2plug.in/ns/ext/atom#AtomPort")
+	madigan := newUri(world, madiganUiUri)
+	defer func() {
+		C.lilv_node_free(input)
+		C.lilv_node_free(output)
+		C.lilv_node_free(audio)
+		C.lilv_node_free(control)
+		C.lilv_node_free(atom)
+		C.lilv_node_free(madigan)
+	}()
+
+	var result []PluginEntry
+	plugins := C.lilv_world_get_all_plugins(world)
+	for iter := C.lilv_plugins_begin(plugins); !C.lilv_plugins_is_end(plugins, iter); iter = C.lilv_plugins_next(plugins, iter) {
+		plugin := C.lilv_plugins_get(plugins, iter)
+
+		entry := PluginEntry{Uri: nodeString(C.lilv_plugin_get_uri(plugin))}
+
+		if name := C.lilv_plugin_get_name(plugin); name != nil {
+			entry.Name = nodeString(name)
+			C.lilv_node_free(name)
+		}
+		if author := C.lilv_plugin_get_author_name(plugin); author != nil {
+			entry.Author = nodeString(author)
+			C.lilv_node_free(author)
+		}
+		if class := C.lilv_plugin_get_class(plugin); class != nil {
+			entry.Class = nodeString(C.lilv_plugin_class_get_label(class))
+			entry.ClassUri = nodeString(C.lilv_plugin_class_get_uri(class))
+		}
+		if bundle := C.lilv_plugin_get_bundle_uri(plugin); bundle != nil {
+			if path := C.lilv_file_uri_parse(C.lilv_node_as_uri(bundle), nil); path != nil {
+				entry.Bundle = C.GoString(path)
+				C.lilv_free(unsafe.Pointer(path))
+			}
+		}
+
+		entry.Ports = PortCounts{
+			AudioIn:    int(C.count_ports(plugin, input, audio)),
+			AudioOut:   int(C.count_ports(plugin, output, audio)),
+			ControlIn:  int(C.count_ports(plugin, input, control)),
+			ControlOut: int(C.count_ports(plugin, output, control)),
+			AtomIn:     int(C.count_ports(plugin, input, atom)),
+			AtomOut:    int(C.count_ports(plugin, output, atom)),
+		}
+
+		if uis := C.lilv_plugin_get_uis(plugin); uis != nil {
+			entry.Madigan = C.lilv_uis_get_by_uri(uis, madigan) != nil
+			C.lilv_uis_free(uis)
+		}
+
+		result = append(result, entry)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return strings.ToLower(result[i].Name) < strings.ToLower(result[j].Name)
+	})
+	return result
+}
+
+// All installed plugins, sorted by name.
+func PluginCatalogue() []PluginEntry {
+	var result []PluginEntry
+	WithWorld(func(world *C.LilvWorld) {
+		if pluginCatalogue == nil {
+			pluginCatalogue = buildCatalogue(world)
+		}
+		result = pluginCatalogue
+	})
+	return result
+}
+
+func (entry PluginEntry) matches(class string, query string) bool {
+	if class != "" && !strings.EqualFold(entry.Class, class) && entry.ClassUri != class {
+		return false
+	}
+	if query != "" {
+		query = strings.ToLower(query)
+		if !strings.Contains(strings.ToLower(entry.Name), query) &&
+			!strings.Contains(strings.ToLower(entry.Uri), query) &&
+			!strings.Contains(strings.ToLower(entry.Author), query) {
+			return false
+		}
+	}
+	return true
+}
+
+// =====================================================================================================
+// PluginsHandler
+// =====================================================================================================
+
+// Lists installed plugins. Optional query parameters: class (label or URI),
+// q (text matched against name, URI and author) and madigan=true to only
+// list plugins with a madigan UI.
+func PluginsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	class := r.URL.Query().Get("class")
+	query := r.URL.Query().Get("q")
+	madiganOnly := r.URL.Query().Get("madigan") == "true"
+
+	result := make([]PluginEntry, 0)
+	for _, entry := range PluginCatalogue() {
+		if madiganOnly && !entry.Madigan {
+			continue
+		}
+		if entry.matches(class, query) {
+			result = append(result, entry)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	http.HandleFunc("/plugins", PluginsHandler)
+}
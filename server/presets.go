@@ -0,0 +1,293 @@
+// =====================================================================================================
+// File:           presets.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Web server service handlers listing and loading LV2 presets
+// =====================================================================================================
+
+package main
+
+// #cgo pkg-config: lilv-0
+// #include <lilv/lilv.h>
+// #include <stdlib.h>
+import "C"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+type Preset struct {
+	Uri   string `json:"uri"`
+	Label string `json:"label"`
+	User  bool   `json:"user"` // Stored in the user's ~/.lv2 rather than shipped with the plugin
+
+	Meta *PresetMeta `json:"meta,omitempty"` // For presets saved by madigan
+}
+
+type PresetLoadResult struct {
+	Preset  string    `json:"preset"`
+	Applied []Setting `json:"applied"`
+	Failed  []Setting `json:"failed,omitempty"`
+}
+
+var errNoSuchPreset = errors.New("no such preset")
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+// Directory where user presets are saved
+func userPresetDir() string {
+	return filepath.Join(homeDir(), ".lv2")
+}
+
+// Local path of a file URI, empty for other URIs.
+func filePath(uri string) string {
+	if !strings.HasPrefix(uri, "file://") {
+		return ""
+	}
+	curi := C.CString(uri)
+	defer C.free(unsafe.Pointer(curi))
+	path := C.lilv_file_uri_parse(curi, nil)
+	if path == nil {
+		return ""
+	}
+	defer C.lilv_free(unsafe.Pointer(path))
+	return C.GoString(path)
+}
+
+func isUserPreset(uri string) bool {
+	path := filePath(uri)
+	return path != "" && strings.HasPrefix(path, userPresetDir()+string(filepath.Separator))
+}
+
+// Presets known for a plugin, sorted by label.
+func PluginPresets(pluginUri string) []Preset {
+	presets := make([]Preset, 0)
+	WithWorld(func(world *C.LilvWorld) {
+		plugin := findPlugin(world, pluginUri)
+		if plugin == nil {
+			return
+		}
+		psetPreset := newUri(world, "http://lv2plug.in/ns/ext/presets#Preset")
+		rdfsLabel := newUri(world, "http://www.w3.org/2000/01/rdf-schema#label")
+		defer C.lilv_node_free(psetPreset)
+		defer C.lilv_node_free(rdfsLabel)
+
+		related := C.lilv_plugin_get_related(plugin, psetPreset)
+		if related == nil {
+			return
+		}
+		defer C.lilv_nodes_free(related)
+		for i := C.lilv_nodes_begin(related); !C.lilv_nodes_is_end(related, i); i = C.lilv_nodes_next(related, i) {
+			node := C.lilv_nodes_get(related, i)
+			// Preset files are not loaded with the plugin data
+			C.lilv_world_load_resource(world, node)
+
+			preset := Preset{Uri: nodeString(node)}
+			if label := C.lilv_world_get(world, node, rdfsLabel, nil); label != nil {
+				preset.Label = nodeString(label)
+				C.lilv_node_free(label)
+			} else {
+				preset.Label = preset.Uri
+			}
+			preset.User = isUserPreset(preset.Uri)
+			presets = append(presets, preset)
+		}
+	})
+	for i := range presets {
+		presets[i].Meta = presetMetaOf(presets[i].Uri)
+	}
+	sort.Slice(presets, func(i, j int) bool { return strings.ToLower(presets[i].Label) < strings.ToLower(presets[j].Label) })
+	return presets
+}
+
+// Text form of a stored value. Paths are stored as file URIs.
+func presetValue(node *C.LilvNode) string {
+	if C.lilv_node_is_uri(node) == true {
+		uri := nodeString(node)
+		if path := filePath(uri); path != "" {
+			return path
+		}
+		return uri
+	}
+	if C.lilv_node_is_float(node) == true || C.lilv_node_is_int(node) == true {
+		return strconv.FormatFloat(float64(C.lilv_node_as_float(node)), 'f', -1, 32)
+	}
+	return nodeString(node)
+}
+
+// Settings stored in a preset: control port values by port index and state
+// properties for the plugin's patch parameters.
+func PresetSettings(pluginUri string, presetUri string, info AllInfo) ([]Setting, error) {
+	var settings []Setting
+	err := errNoSuchPreset
+	WithWorld(func(world *C.LilvWorld) {
+		plugin := findPlugin(world, pluginUri)
+		if plugin == nil {
+			return
+		}
+		preset := newUri(world, presetUri)
+		psetPreset := newUri(world, "http://lv2plug.in/ns/ext/presets#Preset")
+		rdfType := newUri(world, "http://www.w3.org/1999/02/22-rdf-syntax-ns#type")
+		lv2Port := newUri(world, "http://lv2plug.in/ns/lv2core#port")
+		lv2Symbol := newUri(world, "http://lv2plug.in/ns/lv2core#symbol")
+		psetValue := newUri(world, "http://lv2plug.in/ns/ext/presets#value")
+		stateState := newUri(world, "http://lv2plug.in/ns/ext/state#state")
+		defer func() {
+			C.lilv_node_free(preset)
+			C.lilv_node_free(psetPreset)
+			C.lilv_node_free(rdfType)
+			C.lilv_node_free(lv2Port)
+			C.lilv_node_free(lv2Symbol)
+			C.lilv_node_free(psetValue)
+			C.lilv_node_free(stateState)
+		}()
+
+		C.lilv_world_load_resource(world, preset)
+		if C.lilv_world_ask(world, preset, rdfType, psetPreset) != true {
+			return
+		}
+		err = nil
+
+		symbols := make(map[string]string)
+		for _, port := range info.ControlInput {
+			symbols[port.Symbol] = port.Index
+		}
+		ports := C.lilv_world_find_nodes(world, preset, lv2Port, nil)
+		if ports != nil {
+			for i := C.lilv_nodes_begin(ports); !C.lilv_nodes_is_end(ports, i); i = C.lilv_nodes_next(ports, i) {
+				port := C.lilv_nodes_get(ports, i)
+				symbol := C.lilv_world_get(world, port, lv2Symbol, nil)
+				value := C.lilv_world_get(world, port, psetValue, nil)
+				if symbol != nil && value != nil {
+					if index, ok := symbols[nodeString(symbol)]; ok {
+						settings = append(settings, Setting{Type: "control", Key: index, Value: presetValue(value)})
+					}
+				}
+				if symbol != nil {
+					C.lilv_node_free(symbol)
+				}
+				if value != nil {
+					C.lilv_node_free(value)
+				}
+			}
+			C.lilv_nodes_free(ports)
+		}
+
+		// lilv cannot list the properties of a node, so ask for each known parameter
+		state := C.lilv_world_get(world, preset, stateState, nil)
+		if state == nil {
+			return
+		}
+		defer C.lilv_node_free(state)
+		for _, param := range info.PatchParameter {
+			property := newUri(world, param.Uri)
+			if value := C.lilv_world_get(world, state, property, nil); value != nil {
+				settings = append(settings, Setting{Type: "patch", Key: param.Uri, Value: presetValue(value)})
+				C.lilv_node_free(value)
+			}
+			C.lilv_node_free(property)
+		}
+	})
+	return settings, err
+}
+
+// Send the settings of a preset to the plugin UI of a connection, validated
+// and recorded for undo like any other edit.
+func LoadPreset(context string, presetUri string) (PresetLoadResult, error) {
+	pluginUri := GetPluginUri(context)
+	if pluginUri == "" {
+		return PresetLoadResult{}, ErrNoConnection
+	}
+	settings, err := PresetSettings(pluginUri, presetUri, ConnectionParamInfo(context))
+	if err != nil {
+		return PresetLoadResult{}, err
+	}
+	sent, err := SetParameters(context, settings)
+	if err != nil {
+		return PresetLoadResult{}, err
+	}
+	result := PresetLoadResult{Preset: presetUri, Applied: make([]Setting, 0, len(settings))}
+	for _, item := range sent {
+		if item.Ok {
+			result.Applied = append(result.Applied, item.Setting)
+		} else {
+			result.Failed = append(result.Failed, item.Setting)
+		}
+	}
+	return result, nil
+}
+
+// =====================================================================================================
+// presetsHandler
+// =====================================================================================================
+func presetsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	context := r.URL.Query().Get("context")
+	if context == "" {
+		http.Error(w, "No context specified", 400)
+		return
+	}
+	pluginUri := GetPluginUri(context)
+	if pluginUri == "" {
+		http.Error(w, "No such connection", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PluginPresets(pluginUri))
+}
+
+// =====================================================================================================
+// presetLoadHandler
+// =====================================================================================================
+func presetLoadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	context := r.URL.Query().Get("context")
+	uri := r.URL.Query().Get("uri")
+	if context == "" || uri == "" {
+		http.Error(w, "Missing 'context' or 'uri' parameter", 400)
+		return
+	}
+	result, err := LoadPreset(context, uri)
+	switch {
+	case errors.Is(err, ErrNoConnection):
+		http.Error(w, "No such connection", 404)
+		return
+	case errors.Is(err, errNoSuchPreset):
+		http.Error(w, fmt.Sprintf("No such preset: %s", uri), 404)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	http.HandleFunc("/presets", presetsHandler)
+	http.HandleFunc("/presets/load", presetLoadHandler)
+}
@@ -0,0 +1,545 @@
+// =====================================================================================================
+// File:           presetsave.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Web server service handlers saving, renaming and deleting user presets
+// =====================================================================================================
+
+package main
+
+// #cgo pkg-config: lilv-0
+// #include <lilv/lilv.h>
+// #include <stdlib.h>
+import "C"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+const presetBundleSuffix = ".preset.lv2"
+
+const presetPrefixes = `@prefix atom: <http://lv2plug.in/ns/ext/atom#> .
+@prefix lv2: <http://lv2plug.in/ns/lv2core#> .
+@prefix pset: <http://lv2plug.in/ns/ext/presets#> .
+@prefix rdfs: <http://www.w3.org/2000/01/rdf-schema#> .
+@prefix state: <http://lv2plug.in/ns/ext/state#> .
+@prefix xsd: <http://www.w3.org/2001/XMLSchema#> .
+
+`
+
+// What madigan knows about a preset it saved, beyond the Turtle files
+type PresetMeta struct {
+	Plugin   string    `json:"plugin"`
+	Alias    string    `json:"alias,omitempty"` // Instance the preset was saved from
+	Created  time.Time `json:"created"`
+	Modified time.Time `json:"modified"`
+}
+
+// rdfs:label with its literal, short or long quoted, and language tag
+var turtleLabel = regexp.MustCompile(`((?:rdfs:label|<http://www\.w3\.org/2000/01/rdf-schema#label>)\s+)(?:"""(?s:.*?)"""|'''(?s:.*?)'''|"(?:[^"\\\n]|\\.)*"|'(?:[^'\\\n]|\\.)*')(?:@[A-Za-z0-9-]+)?`)
+
+var (
+	errPresetExists  = errors.New("preset already exists")
+	errPresetPlugin  = errors.New("preset bundle belongs to another plugin")
+	errNotUserPreset = errors.New("not a user preset")
+	errBadLabel      = errors.New("invalid preset label")
+	errSharedBundle  = errors.New("preset bundle holds other presets as well")
+)
+
+// =====================================================================================================
+// Local state
+// =====================================================================================================
+
+var (
+	presetMeta   = make(map[string]PresetMeta) // By preset URI
+	presetMetaMu sync.Mutex
+)
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+func presetMetaOf(uri string) *PresetMeta {
+	presetMetaMu.Lock()
+	defer presetMetaMu.Unlock()
+	meta, ok := presetMeta[uri]
+	if !ok {
+		return nil
+	}
+	return &meta
+}
+
+// Record a saved or renamed preset, or forget a deleted one if plugin is empty.
+func updatePresetMeta(uri string, plugin string, alias string) {
+	presetMetaMu.Lock()
+	defer presetMetaMu.Unlock()
+	if plugin == "" {
+		delete(presetMeta, uri)
+	} else {
+		now := time.Now()
+		meta, ok := presetMeta[uri]
+		if !ok {
+			meta = PresetMeta{Plugin: plugin, Alias: alias, Created: now}
+		}
+		meta.Modified = now
+		presetMeta[uri] = meta
+	}
+	persist("presets", presetMeta)
+}
+
+func loadPresetMeta() {
+	presetMetaMu.Lock()
+	defer presetMetaMu.Unlock()
+	if err := LoadDocument("presets", &presetMeta); err != nil {
+		log.Println("Loading preset metadata failed:", err)
+	}
+}
+
+func turtleString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// Turtle IRI reference. Characters an IRIREF can't hold are percent-encoded.
+func turtleUri(uri string) string {
+	var b strings.Builder
+	b.WriteByte('<')
+	for i := 0; i < len(uri); i++ {
+		if c := uri[i]; c <= ' ' || strings.IndexByte("<>\"{}|^`\\", c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('>')
+	return b.String()
+}
+
+func fileUri(path string) string {
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+// Turtle literal for a control port value, always written as a decimal.
+func turtleDecimal(f float64) string {
+	s := strconv.FormatFloat(f, 'f', -1, 32)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+// Turtle object for a state property value, typed as lilv writes atoms.
+func turtleValue(value StateValue) string {
+	switch value.Kind {
+	case KindFloat:
+		return turtleString(value.String()) + "^^xsd:float"
+	case KindDouble:
+		return turtleString(value.String()) + "^^xsd:double"
+	case KindInt:
+		return turtleString(value.String()) + "^^xsd:int"
+	case KindLong:
+		return turtleString(value.String()) + "^^xsd:long"
+	case KindBool:
+		return strconv.FormatBool(value.Number != 0)
+	case KindPath:
+		return turtleUri(fileUri(value.Text))
+	case KindUri, KindUrid:
+		return turtleUri(value.Text)
+	}
+	return turtleString(value.Text)
+}
+
+// File name used for a preset label or plugin name, keeping letters, digits,
+// '-' and '_'.
+func presetFileName(label string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, label)
+	return strings.Trim(name, "_")
+}
+
+// Write the Turtle files of a preset bundle. The preset is described in
+// <name>.ttl, which becomes the preset URI, and listed in manifest.ttl.
+func writePresetBundle(bundle string, name string, pluginUri string, label string, ports map[string]float64, properties map[string]StateValue) error {
+	if err := os.MkdirAll(bundle, 0755); err != nil {
+		return err
+	}
+
+	var manifest strings.Builder
+	manifest.WriteString(presetPrefixes)
+	fmt.Fprintf(&manifest, "<%s.ttl>\n\tlv2:appliesTo %s ;\n\ta pset:Preset ;\n\trdfs:seeAlso <%s.ttl> .\n", name, turtleUri(pluginUri), name)
+
+	var preset strings.Builder
+	preset.WriteString(presetPrefixes)
+	fmt.Fprintf(&preset, "<>\n\ta pset:Preset ;\n\tlv2:appliesTo %s ;\n\trdfs:label %s", turtleUri(pluginUri), turtleString(label))
+
+	symbols := make([]string, 0, len(ports))
+	for symbol := range ports {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	for i, symbol := range symbols {
+		if i == 0 {
+			preset.WriteString(" ;\n\tlv2:port [\n")
+		} else {
+			preset.WriteString(" , [\n")
+		}
+		fmt.Fprintf(&preset, "\t\tlv2:symbol %s ;\n\t\tpset:value %s\n\t]", turtleString(symbol), turtleDecimal(ports[symbol]))
+	}
+
+	uris := make([]string, 0, len(properties))
+	for uri := range properties {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+	for i, uri := range uris {
+		if i == 0 {
+			preset.WriteString(" ;\n\tstate:state [\n")
+		} else {
+			preset.WriteString(" ;\n")
+		}
+		fmt.Fprintf(&preset, "\t\t%s %s", turtleUri(uri), turtleValue(properties[uri]))
+	}
+	if len(uris) > 0 {
+		preset.WriteString("\n\t]")
+	}
+	preset.WriteString(" .\n")
+
+	if err := writeFileAtomic(filepath.Join(bundle, name+".ttl"), []byte(preset.String())); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(bundle, "manifest.ttl"), []byte(manifest.String()))
+}
+
+// Plugin a preset applies to, empty if the world doesn't know the preset.
+// Must be called from WithWorld.
+func presetPlugin(world *C.LilvWorld, presetUri string) string {
+	node := newUri(world, presetUri)
+	appliesTo := newUri(world, "http://lv2plug.in/ns/lv2core#appliesTo")
+	defer C.lilv_node_free(node)
+	defer C.lilv_node_free(appliesTo)
+	plugin := C.lilv_world_get(world, node, appliesTo, nil)
+	if plugin == nil {
+		return ""
+	}
+	defer C.lilv_node_free(plugin)
+	return nodeString(plugin)
+}
+
+// Presets the world knows in a bundle directory. Must be called from WithWorld.
+func bundlePresets(world *C.LilvWorld, bundle string) []string {
+	rdfType := newUri(world, "http://www.w3.org/1999/02/22-rdf-syntax-ns#type")
+	psetPreset := newUri(world, "http://lv2plug.in/ns/ext/presets#Preset")
+	defer C.lilv_node_free(rdfType)
+	defer C.lilv_node_free(psetPreset)
+	nodes := C.lilv_world_find_nodes(world, nil, rdfType, psetPreset)
+	if nodes == nil {
+		return nil
+	}
+	defer C.lilv_nodes_free(nodes)
+	var presets []string
+	for i := C.lilv_nodes_begin(nodes); !C.lilv_nodes_is_end(nodes, i); i = C.lilv_nodes_next(nodes, i) {
+		uri := nodeString(C.lilv_nodes_get(nodes, i))
+		if path := filePath(uri); path != "" && filepath.Dir(path) == bundle {
+			presets = append(presets, uri)
+		}
+	}
+	return presets
+}
+
+// Check that a user preset is known and alone in its bundle, so changing
+// the bundle can't touch other presets. Returns the plugin it applies to.
+// Must be called from WithWorld.
+func ownBundlePreset(world *C.LilvWorld, presetUri string, bundle string) (string, error) {
+	pluginUri := presetPlugin(world, presetUri)
+	if pluginUri == "" {
+		return "", errNoSuchPreset
+	}
+	if len(bundlePresets(world, bundle)) > 1 {
+		return "", errSharedBundle
+	}
+	return pluginUri, nil
+}
+
+// Replace the first rdfs:label literal of a Turtle file. A missing label is
+// an error only where required.
+func relabelTurtle(path string, label string, required bool) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	loc := turtleLabel.FindSubmatchIndex(data)
+	if loc == nil {
+		if required {
+			return fmt.Errorf("%s: no rdfs:label", path)
+		}
+		return nil
+	}
+	// Keep the predicate and the whitespace after it, replace literal and language tag
+	relabeled := append([]byte{}, data[:loc[3]]...)
+	relabeled = append(relabeled, turtleString(label)...)
+	relabeled = append(relabeled, data[loc[1]:]...)
+	return writeFileAtomic(path, relabeled)
+}
+
+// Make the world forget and reread a bundle. Must be called from WithWorld.
+func reloadBundle(world *C.LilvWorld, bundle string, load bool) {
+	node := newUri(world, fileUri(bundle)+"/")
+	defer C.lilv_node_free(node)
+	C.lilv_world_unload_bundle(world, node)
+	if load {
+		C.lilv_world_load_bundle(world, node)
+	}
+	pluginCatalogue = nil
+}
+
+// Bundle directory of a user preset.
+func userPresetBundle(presetUri string) (string, error) {
+	if !isUserPreset(presetUri) {
+		return "", errNotUserPreset
+	}
+	bundle := filepath.Dir(filePath(presetUri))
+	if filepath.Dir(bundle) != userPresetDir() || !strings.HasSuffix(bundle, presetBundleSuffix) {
+		return "", errNotUserPreset
+	}
+	return bundle, nil
+}
+
+// Control port values by symbol and patch property values of a connection.
+func connectionPresetValues(context string) (map[string]float64, map[string]StateValue, error) {
+	state, ok := ConnectionState(context)
+	if !ok {
+		return nil, nil, ErrNoConnection
+	}
+	info := ConnectionParamInfo(context)
+	ports := make(map[string]float64)
+	for _, port := range info.ControlInput {
+		if !port.Input || !port.Control {
+			continue
+		}
+		if value, ok := state[StateKey{Type: "control", Key: port.Index}]; ok {
+			ports[port.Symbol] = value.Number
+		}
+	}
+	properties := make(map[string]StateValue)
+	for _, param := range info.PatchParameter {
+		if value, ok := state[StateKey{Type: "patch", Key: param.Uri}]; ok {
+			properties[param.Uri] = value
+		}
+	}
+	return ports, properties, nil
+}
+
+// Save the current state of a connection as a user preset.
+func SavePreset(context string, label string, overwrite bool) (Preset, error) {
+	name := presetFileName(label)
+	if name == "" {
+		return Preset{}, errBadLabel
+	}
+	pluginUri := GetPluginUri(context)
+	if pluginUri == "" {
+		return Preset{}, ErrNoConnection
+	}
+	ports, properties, err := connectionPresetValues(context)
+	if err != nil {
+		return Preset{}, err
+	}
+	// Named like jalv does, plugins sharing a label get their own bundles
+	bundle := filepath.Join(userPresetDir(), presetFileName(pluginName(pluginUri))+"_"+name+presetBundleSuffix)
+	_, statErr := os.Stat(bundle)
+	exists := statErr == nil
+	if exists && !overwrite {
+		return Preset{}, errPresetExists
+	}
+
+	preset := Preset{Uri: fileUri(filepath.Join(bundle, name+".ttl")), Label: label, User: true}
+	WithWorld(func(world *C.LilvWorld) {
+		// Only replace a bundle holding this preset for the same plugin
+		if exists && presetPlugin(world, preset.Uri) != pluginUri {
+			err = errPresetPlugin
+			return
+		}
+		if err = writePresetBundle(bundle, name, pluginUri, label, ports, properties); err == nil {
+			reloadBundle(world, bundle, true)
+		}
+	})
+	if err == nil {
+		alias, _ := contextKey(context)
+		updatePresetMeta(preset.Uri, pluginUri, alias)
+		preset.Meta = presetMetaOf(preset.Uri)
+	}
+	return preset, err
+}
+
+// Change the label of a user preset. Only rdfs:label is rewritten in the
+// preset and manifest files, so state written by other hosts is kept and no
+// connection is needed. The bundle and preset URI are kept. Bundles holding
+// more than this preset are refused.
+func RenamePreset(presetUri string, label string) (Preset, error) {
+	if presetFileName(label) == "" {
+		return Preset{}, errBadLabel
+	}
+	bundle, err := userPresetBundle(presetUri)
+	if err != nil {
+		return Preset{}, err
+	}
+	var pluginUri string
+	WithWorld(func(world *C.LilvWorld) {
+		if pluginUri, err = ownBundlePreset(world, presetUri, bundle); err != nil {
+			return
+		}
+		if err = relabelTurtle(filePath(presetUri), label, true); err != nil {
+			return
+		}
+		if err = relabelTurtle(filepath.Join(bundle, "manifest.ttl"), label, false); err != nil {
+			return
+		}
+		node := newUri(world, presetUri)
+		C.lilv_world_unload_resource(world, node)
+		C.lilv_node_free(node)
+		reloadBundle(world, bundle, true)
+	})
+	if err != nil {
+		return Preset{}, err
+	}
+	updatePresetMeta(presetUri, pluginUri, "")
+	return Preset{Uri: presetUri, Label: label, User: true, Meta: presetMetaOf(presetUri)}, nil
+}
+
+// Remove the bundle of a user preset. Bundles holding more than this preset
+// are refused.
+func DeletePreset(presetUri string) error {
+	bundle, err := userPresetBundle(presetUri)
+	if err != nil {
+		return err
+	}
+	WithWorld(func(world *C.LilvWorld) {
+		if _, err = ownBundlePreset(world, presetUri, bundle); err != nil {
+			return
+		}
+		reloadBundle(world, bundle, false)
+		err = os.RemoveAll(bundle)
+	})
+	if err == nil {
+		updatePresetMeta(presetUri, "", "")
+	}
+	return err
+}
+
+func presetErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNoConnection), errors.Is(err, errNoSuchPreset):
+		return 404
+	case errors.Is(err, errPresetExists), errors.Is(err, errPresetPlugin), errors.Is(err, errSharedBundle):
+		return 409
+	case errors.Is(err, errNotUserPreset):
+		return 403
+	case errors.Is(err, errBadLabel):
+		return 400
+	}
+	return 500
+}
+
+// =====================================================================================================
+// presetSaveHandler
+// =====================================================================================================
+func presetSaveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	context := r.URL.Query().Get("context")
+	label := r.URL.Query().Get("label")
+	if context == "" || label == "" {
+		http.Error(w, "Missing 'context' or 'label' parameter", 400)
+		return
+	}
+	preset, err := SavePreset(context, label, r.URL.Query().Get("overwrite") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), presetErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(preset)
+}
+
+// =====================================================================================================
+// presetRenameHandler
+// =====================================================================================================
+func presetRenameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	uri := r.URL.Query().Get("uri")
+	label := r.URL.Query().Get("label")
+	if uri == "" || label == "" {
+		http.Error(w, "Missing 'uri' or 'label' parameter", 400)
+		return
+	}
+	preset, err := RenamePreset(uri, label)
+	if err != nil {
+		http.Error(w, err.Error(), presetErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preset)
+}
+
+// =====================================================================================================
+// presetDeleteHandler
+// =====================================================================================================
+func presetDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	uri := r.URL.Query().Get("uri")
+	if uri == "" {
+		http.Error(w, "Missing 'uri' parameter", 400)
+		return
+	}
+	if err := DeletePreset(uri); err != nil {
+		http.Error(w, err.Error(), presetErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	http.HandleFunc("/presets/save", presetSaveHandler)
+	http.HandleFunc("/presets/rename", presetRenameHandler)
+	http.HandleFunc("/presets/delete", presetDeleteHandler)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestTurtleValue(t *testing.T) {
+	tests := []struct {
+		value StateValue
+		want  string
+	}{
+		{StateValue{Kind: KindFloat, Number: 0.5}, `"0.5"^^xsd:float`},
+		{StateValue{Kind: KindDouble, Number: 0.1}, `"0.1"^^xsd:double`},
+		{StateValue{Kind: KindInt, Number: -3}, `"-3"^^xsd:int`},
+		{StateValue{Kind: KindLong, Number: 1 << 40}, `"1099511627776"^^xsd:long`},
+		{StateValue{Kind: KindBool, Number: 1}, `true`},
+		{StateValue{Kind: KindBool, Number: 0}, `false`},
+		{StateValue{Kind: KindString, Text: "say \"hi\"\nback\\slash"}, `"say \"hi\"\nback\\slash"`},
+		{StateValue{Kind: KindPath, Text: "/media/My Samples/kick<1>.wav"}, `<file:///media/My%20Samples/kick%3C1%3E.wav>`},
+		{StateValue{Kind: KindUri, Text: "urn:test#a>b c"}, `<urn:test#a%3Eb%20c>`},
+	}
+	for _, test := range tests {
+		if got := turtleValue(test.value); got != test.want {
+			t.Errorf("turtleValue(%+v) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+// Compare the files of a written bundle with testdata/presets/<dir>.
+func checkGolden(t *testing.T, bundle string, dir string, files ...string) {
+	t.Helper()
+	for _, file := range files {
+		got, err := os.ReadFile(filepath.Join(bundle, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		golden := filepath.Join("testdata", "presets", dir, file)
+		if *updateGolden {
+			if err := writeFileAtomic(golden, got); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("%s differs from %s:\n%s", file, golden, got)
+		}
+	}
+}
+
+func goldenProperties() map[string]StateValue {
+	return map[string]StateValue{
+		"urn:test#name":   {Kind: KindString, Text: "Lead \"Fat\"\nLayer"},
+		"urn:test#bypass": {Kind: KindBool, Number: 1},
+		"urn:test#sample": {Kind: KindPath, Text: "/media/My Samples/kick.wav"},
+		"urn:test#steps":  {Kind: KindInt, Number: 16},
+		"urn:test#link>":  {Kind: KindUri, Text: "http://example.org/a>b"},
+	}
+}
+
+func TestWritePresetBundle(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), "Test_Lead.preset.lv2")
+	ports := map[string]float64{"gain": 0.25, "cutoff": 440, "mode": 2}
+	if err := writePresetBundle(bundle, "Lead", "urn:test:plugin>", "Lead \"Fat\"", ports, goldenProperties()); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, bundle, "full", "Lead.ttl", "manifest.ttl")
+	if tmp, _ := filepath.Glob(filepath.Join(bundle, "*.tmp")); len(tmp) > 0 {
+		t.Errorf("temporary files left behind: %v", tmp)
+	}
+}
+
+func TestWritePresetBundleEmpty(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), "Test_Empty.preset.lv2")
+	if err := writePresetBundle(bundle, "Empty", "urn:test:plugin", "Empty", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, bundle, "empty", "Empty.ttl", "manifest.ttl")
+}
+
+// A saved preset loads back through lilv with the values written.
+func TestPresetSettingsReadsBundle(t *testing.T) {
+	lv2Path := t.TempDir()
+	t.Cleanup(func() { Rescan() })
+	t.Setenv("LV2_PATH", lv2Path)
+
+	pluginUri := "urn:test:preset-plugin"
+	plugin := "@prefix lv2: <http://lv2plug.in/ns/lv2core#> .\n\n<" + pluginUri + "> a lv2:Plugin ;\n\tlv2:binary <missing.so> .\n"
+	if err := writeFileAtomic(filepath.Join(lv2Path, "test.lv2", "manifest.ttl"), []byte(plugin)); err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(lv2Path, "Test_Lead.preset.lv2")
+	ports := map[string]float64{"gain": 0.25}
+	if err := writePresetBundle(bundle, "Lead", pluginUri, "Lead", ports, goldenProperties()); err != nil {
+		t.Fatal(err)
+	}
+	Rescan()
+
+	info := AllInfo{
+		ControlInput: []Info{{Index: "1", Symbol: "gain", Input: true, Control: true}},
+		PatchParameter: []Info{
+			{Uri: "urn:test#name"},
+			{Uri: "urn:test#sample"},
+			{Uri: "urn:test#steps"},
+		},
+	}
+	settings, err := PresetSettings(pluginUri, fileUri(filepath.Join(bundle, "Lead.ttl")), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"1":               "0.25",
+		"urn:test#name":   "Lead \"Fat\"\nLayer",
+		"urn:test#sample": "/media/My Samples/kick.wav",
+		"urn:test#steps":  "16",
+	}
+	if len(settings) != len(want) {
+		t.Fatalf("got settings %+v, want %v", settings, want)
+	}
+	for _, setting := range settings {
+		if setting.Value != want[setting.Key] {
+			t.Errorf("%s read back as %q, want %q", setting.Key, setting.Value, want[setting.Key])
+		}
+	}
+}
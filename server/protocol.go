@@ -0,0 +1,118 @@
+// =====================================================================================================
+// File:           protocol.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Encoding of the messages exchanged with the LV2 UI
+// =====================================================================================================
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+// Protocol versions. Version 1 is the original pipe delimited format
+// "key|value||key|value" without escaping. Version 2 is a flat JSON object.
+//
+// Messages are carried in ReadMessage/SendMessage frames. The first message
+// from a UI is always in version 1 format, "source|<id>||plugin|<uri>", and
+// a UI supporting version 2 appends "||protocol|2" and optionally the
+// identity hints "||host|<name>||instance|<label>||ordinal|<n>". After that both sides
+// use the negotiated version. Version 2 adds the "batch" command, whose
+// "items" field is a JSON array of {type,key,kind,value} set commands.
+const (
+	ProtocolLegacy = 1
+	ProtocolJSON   = 2
+
+	ProtocolLatest = ProtocolJSON
+)
+
+// Message is one decoded message, a set of named string fields.
+type Message map[string]string
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+// Protocol version requested in a handshake message.
+func handshakeProtocol(message Message) int {
+	version, err := strconv.Atoi(message["protocol"])
+	if err != nil || version < ProtocolLegacy {
+		return ProtocolLegacy
+	}
+	return min(version, ProtocolLatest)
+}
+
+func decodeLegacyMessage(data []byte) (Message, error) {
+	result := Message{}
+	for _, part := range strings.Split(string(data), "||") {
+		key, value, found := strings.Cut(part, "|")
+		if !found || key == "" {
+			return nil, fmt.Errorf("malformed message part %q", part)
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
+func decodeJSONMessage(data []byte) (Message, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var fields map[string]any
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	result := Message{}
+	for key, value := range fields {
+		switch v := value.(type) {
+		case string:
+			result[key] = v
+		case json.Number:
+			result[key] = v.String()
+		case bool:
+			result[key] = strconv.FormatBool(v)
+		case nil:
+			result[key] = ""
+		default:
+			return nil, fmt.Errorf("field %q is not a scalar", key)
+		}
+	}
+	return result, nil
+}
+
+// Decode a message in the given protocol version.
+func decodeMessage(data []byte, version int) (Message, error) {
+	if version >= ProtocolJSON {
+		return decodeJSONMessage(data)
+	}
+	return decodeLegacyMessage(data)
+}
+
+// Encode a message in the given protocol version. Version 1 cannot carry
+// field values containing '|'.
+func encodeMessage(message Message, version int) ([]byte, error) {
+	if version >= ProtocolJSON {
+		return json.Marshal(message)
+	}
+	var b strings.Builder
+	for key, value := range message {
+		if strings.Contains(key, "|") || strings.Contains(value, "|") {
+			return nil, errors.New("value contains '|' which protocol version 1 cannot carry")
+		}
+		if b.Len() > 0 {
+			b.WriteString("||")
+		}
+		b.WriteString(key + "|" + value)
+	}
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestDecodeLegacyMessage(t *testing.T) {
+	tests := []struct {
+		data string
+		want Message // nil for a malformed message
+	}{
+		{"source|ui1||plugin|urn:test", Message{"source": "ui1", "plugin": "urn:test"}},
+		{"source|ui1", Message{"source": "ui1"}},
+		{"value|", Message{"value": ""}},
+		{"value|a|b", Message{"value": "a|b"}},
+		{"source", nil},
+		{"", nil},
+		{"|ui1", nil},
+		{"source|ui1||", nil},
+		{"source|ui1||||plugin|urn:test", nil},
+		{"source|ui1||plugin", nil},
+	}
+	for _, test := range tests {
+		got, err := decodeLegacyMessage([]byte(test.data))
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.data, got)
+			}
+			continue
+		}
+		if err != nil || !maps.Equal(got, test.want) {
+			t.Errorf("%q: got %v %v, want %v", test.data, got, err, test.want)
+		}
+	}
+}
+
+func TestDecodeJSONMessage(t *testing.T) {
+	tests := []struct {
+		data string
+		want Message // nil for a malformed message
+	}{
+		{`{"cmd":"set","key":"1","value":"0.5"}`, Message{"cmd": "set", "key": "1", "value": "0.5"}},
+		{`{"value":0.1,"big":12345678901234567890}`, Message{"value": "0.1", "big": "12345678901234567890"}},
+		{`{"on":true,"off":false,"none":null}`, Message{"on": "true", "off": "false", "none": ""}},
+		{`{"text":"a|b||c\n"}`, Message{"text": "a|b||c\n"}},
+		{`{}`, Message{}},
+		{`{"items":[1,2]}`, nil},
+		{`{"object":{"a":"b"}}`, nil},
+		{`["cmd","set"]`, nil},
+		{`"set"`, nil},
+		{``, nil},
+		{`{"cmd":"set"`, nil},
+	}
+	for _, test := range tests {
+		got, err := decodeJSONMessage([]byte(test.data))
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.data, got)
+			}
+			continue
+		}
+		if err != nil || !maps.Equal(got, test.want) {
+			t.Errorf("%q: got %v %v, want %v", test.data, got, err, test.want)
+		}
+	}
+}
+
+func TestEncodeMessageRoundTrip(t *testing.T) {
+	message := Message{"cmd": "set", "key": "urn:test#name", "value": "x"}
+	for _, version := range []int{ProtocolLegacy, ProtocolJSON} {
+		data, err := encodeMessage(message, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeMessage(data, version)
+		if err != nil || !maps.Equal(got, message) {
+			t.Errorf("version %d: got %v %v, want %v", version, got, err, message)
+		}
+	}
+	if _, err := encodeMessage(Message{"value": "a|b"}, ProtocolLegacy); err == nil {
+		t.Error("version 1 should refuse values containing '|'")
+	}
+	data, err := encodeMessage(Message{"value": "a|b"}, ProtocolJSON)
+	if got, _ := decodeMessage(data, ProtocolJSON); err != nil || got["value"] != "a|b" {
+		t.Errorf("version 2 should carry '|', got %v %v", got, err)
+	}
+}
@@ -0,0 +1,349 @@
+// =====================================================================================================
+// File:           restore.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Restore of the last known parameter state when an aliased plugin instance reconnects
+// =====================================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+// Restore policies
+const (
+	RestoreIgnore = "ignore"
+	RestoreApply  = "restore"
+	RestoreAsk    = "ask"
+)
+
+// Type of the parameter events announcing a restore offer, the key is the alias
+const restoreEventType = "restore"
+
+// SavedState is the state an instance had when its UI last disconnected.
+type SavedState struct {
+	Alias    string    `json:"alias"`
+	Saved    time.Time `json:"saved"`
+	Settings []Setting `json:"settings"`
+}
+
+// Saved state offered to the connection it was offered to
+type restoreOffer struct {
+	SavedState
+	conn *UIConnection
+}
+
+// Saved state of a reconnected instance, waiting for the UI to report the
+// values it has
+type pendingRestore struct {
+	SavedState
+	conn   *UIConnection
+	policy string
+	settle *time.Timer
+}
+
+var errNoRestoreOffer = errors.New("no saved state offered for this context")
+
+// =====================================================================================================
+// Local state
+// =====================================================================================================
+
+var (
+	lastStates    = make(map[string]SavedState)      // By alias
+	restoreOffers = make(map[string]restoreOffer)    // By connection id, for the ask policy
+	pendingStates = make(map[string]*pendingRestore) // By connection id, until the UI has reported
+	restoreMu     sync.Mutex
+)
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+func validRestorePolicy(policy string) bool {
+	return policy == RestoreIgnore || policy == RestoreApply || policy == RestoreAsk
+}
+
+// Restore policy of an alias.
+func aliasRestorePolicy(name string) string {
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	for _, alias := range aliases {
+		if alias.Alias == name && alias.Restore != "" {
+			return alias.Restore
+		}
+	}
+	return restorePolicy
+}
+
+func SetRestorePolicy(name string, policy string) error {
+	if !validRestorePolicy(policy) {
+		return fmt.Errorf("invalid restore policy %q, expected ignore, restore or ask", policy)
+	}
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	for _, alias := range aliases {
+		if alias.Alias == name {
+			alias.Restore = policy
+			saveAliases()
+			return nil
+		}
+	}
+	return errNoSuchAlias
+}
+
+// Keep the input parameter values of an aliased connection that is ending.
+func rememberState(conn *UIConnection) {
+	mu.Lock()
+	alias := conn.Alias
+	values := make(StateCache)
+	for key, value := range conn.Reported {
+		if conn.Info.Settable(key.Type, key.Key) {
+			values[key] = value
+		}
+	}
+	mu.Unlock()
+	if alias == "" || len(values) == 0 {
+		return
+	}
+	restoreMu.Lock()
+	lastStates[alias] = SavedState{Alias: alias, Saved: time.Now(), Settings: snapshotSettings(values)}
+	persist("last-state", lastStates)
+	restoreMu.Unlock()
+}
+
+func renameLastState(old string, name string) {
+	restoreMu.Lock()
+	defer restoreMu.Unlock()
+	if saved, ok := lastStates[old]; ok {
+		saved.Alias = name
+		lastStates[name] = saved
+		delete(lastStates, old)
+		persist("last-state", lastStates)
+	}
+}
+
+func loadLastStates() {
+	restoreMu.Lock()
+	defer restoreMu.Unlock()
+	if err := LoadDocument("last-state", &lastStates); err != nil {
+		log.Println("Loading last known states failed:", err)
+	}
+}
+
+// Hold the last known state of a newly connected instance until its UI
+// has reported the values the instance has. Nothing is restored or offered
+// if they match, like when a UI window is closed and opened again.
+func offerLastState(conn *UIConnection) {
+	if conn.Alias == "" {
+		return
+	}
+	policy := aliasRestorePolicy(conn.Alias)
+	if policy == RestoreIgnore {
+		return
+	}
+	restoreMu.Lock()
+	defer restoreMu.Unlock()
+	saved, ok := lastStates[conn.Alias]
+	if !ok {
+		return
+	}
+	pending := &pendingRestore{SavedState: saved, conn: conn, policy: policy}
+	pending.settle = time.AfterFunc(restoreSettle, func() { compareLastState(conn, true) })
+	pendingStates[conn.Id] = pending
+}
+
+// Compare the values reported by a reconnected UI with its last known
+// state once all of them are reported, or when settled is set, with the
+// ones reported so far. Matching values drop the saved state, differing
+// ones are restored or offered by the restore policy.
+func compareLastState(conn *UIConnection, settled bool) {
+	restoreMu.Lock()
+	pending := pendingStates[conn.Id]
+	restoreMu.Unlock()
+	if pending == nil || pending.conn != conn {
+		return
+	}
+
+	differs, complete := false, true
+	mu.Lock()
+	for _, setting := range pending.Settings {
+		value, ok := conn.Reported[StateKey{Type: setting.Type, Key: setting.Key}]
+		if !ok {
+			complete = false
+		} else if value.String() != setting.Value {
+			differs = true
+		}
+	}
+	mu.Unlock()
+	if !complete && !settled {
+		return
+	}
+
+	restoreMu.Lock()
+	if pendingStates[conn.Id] != pending {
+		restoreMu.Unlock()
+		return
+	}
+	delete(pendingStates, conn.Id)
+	pending.settle.Stop()
+	if !differs {
+		if lastStates[pending.Alias].Saved.Equal(pending.Saved) {
+			delete(lastStates, pending.Alias)
+			persist("last-state", lastStates)
+		}
+		restoreMu.Unlock()
+		return
+	}
+	if pending.policy == RestoreAsk {
+		restoreOffers[conn.Id] = restoreOffer{SavedState: pending.SavedState, conn: conn}
+	}
+	restoreMu.Unlock()
+
+	switch pending.policy {
+	case RestoreApply:
+		log.Printf("Restoring %d saved values of %s", len(pending.Settings), pending.Alias)
+		if _, err := SetParameters(conn.Id, pending.Settings); err != nil {
+			log.Printf("Restoring %s failed: %v", pending.Alias, err)
+		}
+	case RestoreAsk:
+		offer := pending.event(conn.Id)
+		Publish(conn.Id, StateKey{Type: offer.Type, Key: offer.Key}, StateValue{Kind: offer.Kind, Text: offer.Value, Updated: offer.Time})
+	}
+}
+
+// Event telling browsers that saved state can be restored, the value is
+// the time it was saved.
+func (saved SavedState) event(context string) ParameterEvent {
+	return ParameterEvent{Context: context, Type: restoreEventType, Key: saved.Alias, Kind: KindString, Value: saved.Saved.Format(time.RFC3339), Time: time.Now()}
+}
+
+func RestoreOffer(context string) (SavedState, bool) {
+	restoreMu.Lock()
+	defer restoreMu.Unlock()
+	offer, ok := restoreOffers[context]
+	return offer.SavedState, ok
+}
+
+func dropRestoreOffer(context string) {
+	restoreMu.Lock()
+	delete(restoreOffers, context)
+	restoreMu.Unlock()
+}
+
+// Drop the offer made to a connection that is ending. A UI reconnecting
+// with the same id may already have been given a new offer, which is kept.
+func withdrawRestoreOffer(conn *UIConnection) {
+	restoreMu.Lock()
+	if restoreOffers[conn.Id].conn == conn {
+		delete(restoreOffers, conn.Id)
+	}
+	if pending := pendingStates[conn.Id]; pending != nil && pending.conn == conn {
+		pending.settle.Stop()
+		delete(pendingStates, conn.Id)
+	}
+	restoreMu.Unlock()
+}
+
+// Accept the restore offer of a connection.
+func AcceptRestore(context string) ([]BatchResult, error) {
+	saved, ok := RestoreOffer(context)
+	if !ok {
+		return nil, errNoRestoreOffer
+	}
+	dropRestoreOffer(context)
+	return SetParameters(context, saved.Settings)
+}
+
+// =====================================================================================================
+// restoreHandler
+// =====================================================================================================
+
+// GET shows the saved state offered to a context, POST restores it and
+// DELETE declines it.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	context := r.URL.Query().Get("context")
+	if context == "" {
+		http.Error(w, "No context specified", 400)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		saved, ok := RestoreOffer(context)
+		if !ok {
+			http.Error(w, errNoRestoreOffer.Error(), 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(saved)
+	case http.MethodPost:
+		results, err := AcceptRestore(context)
+		if errors.Is(err, errNoRestoreOffer) {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), sendErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	case http.MethodDelete:
+		dropRestoreOffer(context)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// =====================================================================================================
+// restorePolicyHandler
+// =====================================================================================================
+func restorePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	alias := r.URL.Query().Get("alias")
+	policy := r.URL.Query().Get("restore")
+	if alias == "" || policy == "" {
+		http.Error(w, "Missing 'alias' or 'restore' parameter", 400)
+		return
+	}
+	err := SetRestorePolicy(alias, policy)
+	if errors.Is(err, errNoSuchAlias) {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	if !validRestorePolicy(restorePolicy) {
+		log.Printf("Invalid MADIGAN_RESTORE_POLICY=%q, using %s", restorePolicy, RestoreAsk)
+		restorePolicy = RestoreAsk
+	}
+
+	http.HandleFunc("/restore", restoreHandler)
+	http.HandleFunc("/aliases/policy", restorePolicyHandler)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Connect a UI of an aliased instance with saved state 0.75 for port 1.
+func reconnectTestUI(t *testing.T, id string, policy string) *testUI {
+	t.Helper()
+	alias := AssignAlias(Identity{Host: "restore-host", Instance: id, Plugin: "urn:test"})
+	if err := SetRestorePolicy(alias, policy); err != nil {
+		t.Fatal(err)
+	}
+	restoreMu.Lock()
+	lastStates[alias] = SavedState{Alias: alias, Saved: time.Now(), Settings: []Setting{{Type: "control", Key: "1", Value: "0.75"}}}
+	restoreMu.Unlock()
+
+	ui := connectTestUI(t, id, ProtocolJSON, testInfo())
+	mu.Lock()
+	ui.conn.Alias = alias
+	mu.Unlock()
+	offerLastState(ui.conn)
+	return ui
+}
+
+func hasLastState(alias string) bool {
+	restoreMu.Lock()
+	defer restoreMu.Unlock()
+	_, ok := lastStates[alias]
+	return ok
+}
+
+// The batch restoring the saved state.
+func expectRestore(t *testing.T, ui *testUI) {
+	t.Helper()
+	m := ui.next(t)
+	var items []batchItem
+	if err := json.Unmarshal([]byte(m["items"]), &items); m["cmd"] != "batch" || err != nil || len(items) != 1 || items[0].Key != "1" || items[0].Value != "0.75" {
+		t.Fatalf("expected the saved value to be restored, got %v", m)
+	}
+}
+
+func restoreRequest(method string, context string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	restoreHandler(w, httptest.NewRequest(method, "/restore?context="+context, nil))
+	return w
+}
+
+func TestRestoreApply(t *testing.T) {
+	ui := reconnectTestUI(t, "restore-apply", RestoreApply)
+	ui.report(map[string]string{"1": "0.25"})
+	expectRestore(t, ui)
+}
+
+func TestRestoreAskAccept(t *testing.T) {
+	ui := reconnectTestUI(t, "restore-accept", RestoreAsk)
+	if _, ok := RestoreOffer("restore-accept"); ok {
+		t.Fatal("nothing should be offered before the UI has reported")
+	}
+	ui.report(map[string]string{"1": "0.25"})
+	if w := restoreRequest(http.MethodGet, "restore-accept"); w.Code != http.StatusOK {
+		t.Fatalf("expected an offer, got %d %s", w.Code, w.Body)
+	}
+	if w := restoreRequest(http.MethodPost, "restore-accept"); w.Code != http.StatusOK {
+		t.Fatalf("accepting the offer failed: %d %s", w.Code, w.Body)
+	}
+	expectRestore(t, ui)
+	if w := restoreRequest(http.MethodPost, "restore-accept"); w.Code != http.StatusNotFound {
+		t.Fatalf("the offer should be gone once accepted, got %d", w.Code)
+	}
+}
+
+func TestRestoreAskDecline(t *testing.T) {
+	ui := reconnectTestUI(t, "restore-decline", RestoreAsk)
+	ui.report(map[string]string{"1": "0.25"})
+	if _, ok := RestoreOffer("restore-decline"); !ok {
+		t.Fatal("expected an offer for differing values")
+	}
+	if w := restoreRequest(http.MethodDelete, "restore-decline"); w.Code != http.StatusNoContent {
+		t.Fatalf("declining failed: %d %s", w.Code, w.Body)
+	}
+	if _, ok := RestoreOffer("restore-decline"); ok {
+		t.Fatal("the offer should be gone once declined")
+	}
+}
+
+func TestRestoreMatchingValues(t *testing.T) {
+	ui := reconnectTestUI(t, "restore-same", RestoreApply)
+	ui.report(map[string]string{"1": "0.75"})
+	if hasLastState(ui.conn.Alias) {
+		t.Error("saved state matching the reported values should be dropped")
+	}
+	if _, ok := RestoreOffer("restore-same"); ok {
+		t.Error("matching values should not be offered")
+	}
+}
+
+func TestRestoreSettles(t *testing.T) {
+	defer func(saved time.Duration) { restoreSettle = saved }(restoreSettle)
+	restoreSettle = 20 * time.Millisecond
+
+	ui := reconnectTestUI(t, "restore-settle", RestoreAsk)
+	deadline := time.Now().Add(2 * time.Second)
+	for hasLastState(ui.conn.Alias) {
+		if time.Now().After(deadline) {
+			t.Fatal("saved state should be dropped when the UI reports no differing value")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := RestoreOffer("restore-settle"); ok {
+		t.Error("nothing should be offered without a differing value")
+	}
+}
@@ -44,6 +44,10 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	// State kept across restarts, then the listener for plugin UIs
+	loadState()
+	go tcpHandler()
+
 	// Embedded static files
 	staticFS, _ := fs.Sub(embeddedFiles, "embed")
 	http.Handle("/", http.FileServer(http.FS(staticFS)))
@@ -56,6 +60,7 @@ func main() {
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", port),
+		Handler:      resolveAliases(http.DefaultServeMux),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
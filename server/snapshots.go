@@ -0,0 +1,549 @@
+// =====================================================================================================
+// File:           snapshots.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    In-memory parameter snapshots with A/B compare and morphing
+// =====================================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+type Snapshot struct {
+	Name     string     `json:"name"`
+	Created  time.Time  `json:"created"`
+	Settings []Setting  `json:"settings"`
+	values   StateCache // Values as captured, with kinds
+}
+
+type SnapshotList struct {
+	Active    string     `json:"active,omitempty"` // Last recalled or morphed to
+	Morphing  bool       `json:"morphing"`
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+type contextSnapshots struct {
+	snapshots  map[string]Snapshot
+	active     string
+	stop       chan struct{} // Closed to end the running morph, nil if none
+	stopped    chan struct{} // Closed by the running morph once it has journaled its step
+	persistent bool          // Kept by alias, so stored across restarts
+}
+
+// Snapshot as persisted in the "snapshots" document
+type storedSnapshot struct {
+	Name    string       `json:"name"`
+	Created time.Time    `json:"created"`
+	Values  []StateEntry `json:"values"`
+}
+
+var errNoSuchSnapshot = errors.New("no such snapshot")
+
+// =====================================================================================================
+// Local state
+// =====================================================================================================
+
+var (
+	snapshots   = make(map[string]*contextSnapshots)
+	snapshotsMu sync.Mutex
+)
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+// Snapshots of a context, kept under its alias if it has one.
+// Must be called holding snapshotsMu.
+func contextSnapshotsOf(context string) *contextSnapshots {
+	key, alias := contextKey(context)
+	cs := snapshots[key]
+	if cs == nil {
+		cs = &contextSnapshots{snapshots: make(map[string]Snapshot), persistent: alias}
+		snapshots[key] = cs
+	}
+	return cs
+}
+
+// Must be called holding snapshotsMu.
+func lookupSnapshots(context string) *contextSnapshots {
+	key, _ := contextKey(context)
+	return snapshots[key]
+}
+
+// Must be called holding snapshotsMu.
+func saveSnapshots() {
+	stored := make(map[string][]storedSnapshot)
+	for key, cs := range snapshots {
+		if !cs.persistent || len(cs.snapshots) == 0 {
+			continue
+		}
+		for _, snapshot := range cs.snapshots {
+			entry := storedSnapshot{Name: snapshot.Name, Created: snapshot.Created}
+			for k, value := range snapshot.values {
+				entry.Values = append(entry.Values, StateEntry{Type: k.Type, Key: k.Key, Kind: value.Kind, Value: value.String(), Updated: value.Updated})
+			}
+			stored[key] = append(stored[key], entry)
+		}
+	}
+	persist("snapshots", stored)
+}
+
+func loadSnapshots() {
+	var stored map[string][]storedSnapshot
+	if err := LoadDocument("snapshots", &stored); err != nil {
+		log.Println("Loading snapshots failed:", err)
+		return
+	}
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	for alias, list := range stored {
+		cs := &contextSnapshots{snapshots: make(map[string]Snapshot), persistent: true}
+		for _, entry := range list {
+			values := make(StateCache)
+			for _, v := range entry.Values {
+				value, err := ParseStateValue(v.Kind, v.Value)
+				if err != nil {
+					continue
+				}
+				value.Updated = v.Updated
+				values[StateKey{Type: v.Type, Key: v.Key}] = value
+			}
+			cs.snapshots[entry.Name] = Snapshot{Name: entry.Name, Created: entry.Created, Settings: snapshotSettings(values), values: values}
+		}
+		snapshots[alias] = cs
+	}
+}
+
+// Keep the snapshots of a renamed alias.
+func renameSnapshots(old string, name string) {
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	if cs, ok := snapshots[old]; ok {
+		snapshots[name] = cs
+		delete(snapshots, old)
+		saveSnapshots()
+	}
+}
+
+// Stop the running morph and wait for its undo step, so it is journaled
+// before whatever replaces the morph. Must be called holding snapshotsMu.
+func (cs *contextSnapshots) stopMorph() {
+	if cs.stop != nil {
+		close(cs.stop)
+		<-cs.stopped
+		cs.stop = nil
+		cs.stopped = nil
+	}
+}
+
+func snapshotSettings(values StateCache) []Setting {
+	settings := make([]Setting, 0, len(values))
+	for key, value := range values {
+		settings = append(settings, Setting{Type: key.Type, Key: key.Key, Value: value.String()})
+	}
+	sort.Slice(settings, func(i, j int) bool {
+		if settings[i].Type != settings[j].Type {
+			return settings[i].Type < settings[j].Type
+		}
+		return settings[i].Key < settings[j].Key
+	})
+	return settings
+}
+
+// Capture the input parameters in the state cache of a connection.
+func TakeSnapshot(context string, name string) (Snapshot, error) {
+	state, ok := ConnectionState(context)
+	if !ok {
+		return Snapshot{}, ErrNoConnection
+	}
+	info := ConnectionParamInfo(context)
+	values := make(StateCache)
+	for key, value := range state {
+		if info.Settable(key.Type, key.Key) {
+			values[key] = value
+		}
+	}
+	snapshot := Snapshot{Name: name, Created: time.Now(), Settings: snapshotSettings(values), values: values}
+
+	snapshotsMu.Lock()
+	cs := contextSnapshotsOf(context)
+	cs.snapshots[name] = snapshot
+	if cs.persistent {
+		saveSnapshots()
+	}
+	snapshotsMu.Unlock()
+	return snapshot, nil
+}
+
+func ListSnapshots(context string) SnapshotList {
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	list := SnapshotList{Snapshots: make([]Snapshot, 0)}
+	if cs := lookupSnapshots(context); cs != nil {
+		list.Active = cs.active
+		list.Morphing = cs.stop != nil
+		for _, snapshot := range cs.snapshots {
+			list.Snapshots = append(list.Snapshots, snapshot)
+		}
+	}
+	sort.Slice(list.Snapshots, func(i, j int) bool { return list.Snapshots[i].Created.Before(list.Snapshots[j].Created) })
+	return list
+}
+
+func DeleteSnapshot(context string, name string) error {
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	cs := lookupSnapshots(context)
+	if cs == nil {
+		return errNoSuchSnapshot
+	}
+	if _, ok := cs.snapshots[name]; !ok {
+		return errNoSuchSnapshot
+	}
+	delete(cs.snapshots, name)
+	if cs.active == name {
+		cs.active = ""
+	}
+	if cs.persistent {
+		saveSnapshots()
+	}
+	return nil
+}
+
+// Stop any morph and look up a snapshot to recall.
+func takeOver(context string, name string) (Snapshot, error) {
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	cs := contextSnapshotsOf(context)
+	cs.stopMorph()
+	snapshot, ok := cs.snapshots[name]
+	if !ok {
+		return Snapshot{}, errNoSuchSnapshot
+	}
+	return snapshot, nil
+}
+
+func setActive(context string, name string) {
+	snapshotsMu.Lock()
+	contextSnapshotsOf(context).active = name
+	snapshotsMu.Unlock()
+}
+
+// Send all values of a snapshot to the plugin UI, validated and recorded
+// for undo as one step.
+func RecallSnapshot(context string, name string) error {
+	snapshot, err := takeOver(context, name)
+	if err != nil {
+		return err
+	}
+	if _, err := SetParameters(context, snapshot.Settings); err != nil {
+		return err
+	}
+	setActive(context, name)
+	return nil
+}
+
+// Recall b if a is active, otherwise a. Returns the recalled snapshot name.
+func ToggleSnapshots(context string, a string, b string) (string, error) {
+	snapshotsMu.Lock()
+	next := a
+	if cs := lookupSnapshots(context); cs != nil && cs.active == a {
+		next = b
+	}
+	snapshotsMu.Unlock()
+	return next, RecallSnapshot(context, next)
+}
+
+// Value of a parameter at position t (0..1) between two snapshot values.
+// Continuous values are interpolated, enumerations, toggles and text switch
+// at the midpoint.
+func morphValue(typ string, param Info, a StateValue, b StateValue, t float64) string {
+	if !a.IsNumeric() || !b.IsNumeric() || b.Kind == KindBool || param.Enum || param.Toggle || param.Trigger {
+		if t < 0.5 {
+			return a.String()
+		}
+		return b.String()
+	}
+	value := StateValue{Kind: b.Kind, Number: a.Number + (b.Number-a.Number)*t}
+	if param.Integer || typ == "midicc" {
+		value.Number = math.Round(value.Number)
+	}
+	return value.String()
+}
+
+// Send the interpolated values at morphRate until the morph is done or
+// stopped. The morph is journaled as one step from the values before it to
+// the values it reached, and stopped is closed after that.
+func morph(context string, from Snapshot, to Snapshot, duration time.Duration, stop chan struct{}, stopped chan struct{}) {
+	info := ConnectionParamInfo(context)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / morphRate))
+	defer ticker.Stop()
+
+	finish := func(reached bool) {
+		snapshotsMu.Lock()
+		defer snapshotsMu.Unlock()
+		cs := contextSnapshotsOf(context)
+		if cs.stop == stop {
+			cs.stop = nil
+			cs.stopped = nil
+			if reached {
+				cs.active = to.Name
+			}
+		}
+	}
+
+	changes := make(map[StateKey]*HistoryChange)
+	var order []StateKey
+	journal := func() {
+		var step []HistoryChange
+		for _, key := range order {
+			if change := changes[key]; change.Old != change.New {
+				step = append(step, *change)
+			}
+		}
+		RecordEdits(context, step)
+		close(stopped)
+	}
+
+	start := time.Now()
+	sent := make(map[StateKey]string)
+	for {
+		t := min(float64(time.Since(start))/float64(duration), 1)
+		var settings []Setting
+		for key, b := range to.values {
+			a, ok := from.values[key]
+			if !ok {
+				continue
+			}
+			param, _ := info.Param(key.Type, key.Key)
+			value := morphValue(key.Type, param, a, b, t)
+			if sent[key] == value {
+				continue
+			}
+			settings = append(settings, Setting{Type: key.Type, Key: key.Key, Value: value})
+			sent[key] = value
+		}
+		// Each tick goes out as one batch, the changes are journaled when
+		// the morph ends
+		if len(settings) > 0 {
+			_, applied, err := applyParameters(context, settings)
+			if err != nil {
+				journal()
+				finish(false)
+				return
+			}
+			for _, change := range applied {
+				key := StateKey{Type: change.Type, Key: change.Key}
+				if first, ok := changes[key]; ok {
+					first.New = change.New
+				} else {
+					changes[key] = &change
+					order = append(order, key)
+				}
+			}
+		}
+		if t >= 1 {
+			journal()
+			finish(true)
+			return
+		}
+		select {
+		case <-stop:
+			journal()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Start morphing from one snapshot to another, replacing any running morph.
+func MorphSnapshots(context string, from string, to string, duration time.Duration) error {
+	if GetPluginUri(context) == "" {
+		return ErrNoConnection
+	}
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	cs := contextSnapshotsOf(context)
+	a, okA := cs.snapshots[from]
+	b, okB := cs.snapshots[to]
+	if !okA || !okB {
+		return errNoSuchSnapshot
+	}
+	cs.stopMorph()
+	cs.stop = make(chan struct{})
+	cs.stopped = make(chan struct{})
+	go morph(context, a, b, duration, cs.stop, cs.stopped)
+	return nil
+}
+
+func StopMorph(context string) {
+	snapshotsMu.Lock()
+	contextSnapshotsOf(context).stopMorph()
+	snapshotsMu.Unlock()
+}
+
+// Duration as Go syntax ("1.5s") or plain seconds.
+func parseMorphDuration(value string) (time.Duration, bool) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return d, d > 0
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+func snapshotErrorStatus(err error) int {
+	if errors.Is(err, errNoSuchSnapshot) {
+		return 404
+	}
+	return sendErrorStatus(err)
+}
+
+// =====================================================================================================
+// snapshotsHandler
+// =====================================================================================================
+func snapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	context := r.URL.Query().Get("context")
+	name := r.URL.Query().Get("name")
+	if context == "" {
+		http.Error(w, "No context specified", 400)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ListSnapshots(context))
+	case http.MethodPost:
+		if name == "" {
+			http.Error(w, "Missing 'name' parameter", 400)
+			return
+		}
+		snapshot, err := TakeSnapshot(context, name)
+		if err != nil {
+			http.Error(w, err.Error(), snapshotErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(snapshot)
+	case http.MethodDelete:
+		if err := DeleteSnapshot(context, name); err != nil {
+			http.Error(w, err.Error(), snapshotErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// =====================================================================================================
+// snapshotRecallHandler
+// =====================================================================================================
+func snapshotRecallHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	context := r.URL.Query().Get("context")
+	name := r.URL.Query().Get("name")
+	if context == "" || name == "" {
+		http.Error(w, "Missing 'context' or 'name' parameter", 400)
+		return
+	}
+	if err := RecallSnapshot(context, name); err != nil {
+		http.Error(w, err.Error(), snapshotErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// =====================================================================================================
+// snapshotABHandler
+// =====================================================================================================
+func snapshotABHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	context := r.URL.Query().Get("context")
+	a := r.URL.Query().Get("a")
+	b := r.URL.Query().Get("b")
+	if context == "" || a == "" || b == "" {
+		http.Error(w, "Missing 'context', 'a' or 'b' parameter", 400)
+		return
+	}
+	active, err := ToggleSnapshots(context, a, b)
+	if err != nil {
+		http.Error(w, err.Error(), snapshotErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"active": active})
+}
+
+// =====================================================================================================
+// snapshotMorphHandler
+// =====================================================================================================
+func snapshotMorphHandler(w http.ResponseWriter, r *http.Request) {
+	context := r.URL.Query().Get("context")
+	if context == "" {
+		http.Error(w, "No context specified", 400)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		from := r.URL.Query().Get("from")
+		to := r.URL.Query().Get("to")
+		if from == "" || to == "" {
+			http.Error(w, "Missing 'from' or 'to' parameter", 400)
+			return
+		}
+		duration, ok := parseMorphDuration(r.URL.Query().Get("duration"))
+		if !ok {
+			http.Error(w, "Missing or invalid 'duration' parameter", 400)
+			return
+		}
+		if err := MorphSnapshots(context, from, to, duration); err != nil {
+			http.Error(w, err.Error(), snapshotErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodDelete:
+		StopMorph(context)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	http.HandleFunc("/snapshots", snapshotsHandler)
+	http.HandleFunc("/snapshots/recall", snapshotRecallHandler)
+	http.HandleFunc("/snapshots/ab", snapshotABHandler)
+	http.HandleFunc("/snapshots/morph", snapshotMorphHandler)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Read and discard what is written to the UI.
+func (ui *testUI) drain() {
+	go func() {
+		for {
+			if _, err := ReadMessage(ui.peer); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func snapshotTestUI(t *testing.T, id string) *testUI {
+	t.Helper()
+	ui := connectTestUI(t, id, ProtocolJSON, testInfo())
+	ui.drain()
+	ui.report(map[string]string{"1": "0", "urn:test#cutoff": "100"})
+	if _, err := TakeSnapshot(id, "a"); err != nil {
+		t.Fatal(err)
+	}
+	ui.report(map[string]string{"1": "1", "urn:test#cutoff": "200"})
+	if _, err := TakeSnapshot(id, "b"); err != nil {
+		t.Fatal(err)
+	}
+	ui.report(map[string]string{"1": "0.5", "urn:test#cutoff": "150"})
+	dropHistory(id)
+	return ui
+}
+
+func TestMorphIsOneUndoStep(t *testing.T) {
+	snapshotTestUI(t, "morph-ui")
+	if err := MorphSnapshots("morph-ui", "a", "b", 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for ListSnapshots("morph-ui").Morphing {
+		if time.Now().After(deadline) {
+			t.Fatal("morph did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	h := ListHistory("morph-ui")
+	if len(h.Undo) != 1 || len(h.Undo[0].Changes) != 2 {
+		t.Fatalf("expected the morph as one step of two changes, got %+v", h.Undo)
+	}
+	for _, change := range h.Undo[0].Changes {
+		if change.Key == "1" && (change.Old != "0.5" || change.New != "1") ||
+			change.Key == "urn:test#cutoff" && (change.Old != "150" || change.New != "200") {
+			t.Errorf("change should span the value before the morph to the target, got %+v", change)
+		}
+	}
+}
+
+func TestStoppedMorphIsJournaledBeforeRecall(t *testing.T) {
+	snapshotTestUI(t, "morph-stopped")
+	if err := MorphSnapshots("morph-stopped", "a", "b", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := RecallSnapshot("morph-stopped", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := ListHistory("morph-stopped")
+	if len(h.Undo) != 2 {
+		t.Fatalf("expected a step for the morph and one for the recall, got %+v", h.Undo)
+	}
+	for _, change := range h.Undo[1].Changes {
+		if change.Key == "1" && change.New != "0" || change.Key == "urn:test#cutoff" && change.New != "100" {
+			t.Errorf("last step should be the recall, got %+v", h.Undo[1])
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// =====================================================================================================
+// File:           state.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Typed parameter state cache kept per UI connection
+// =====================================================================================================
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+// Value kinds as reported by the plugin UI
+const (
+	KindFloat  = "float"
+	KindDouble = "double"
+	KindInt    = "int"
+	KindLong   = "long"
+	KindBool   = "bool"
+	KindString = "string"
+	KindPath   = "path"
+	KindUri    = "uri"
+	KindUrid   = "urid"
+)
+
+// StateKey identifies one parameter of a plugin instance. Type is one of
+// "control", "midicc" or "patch" and Key is the port index, CC number or
+// property URI respectively.
+type StateKey struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+}
+
+// Setting is a value to set for one parameter.
+type Setting struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// StateValue is the last value reported for a parameter.
+type StateValue struct {
+	Kind    string    `json:"kind"`
+	Number  float64   `json:"number,omitempty"`
+	Text    string    `json:"text,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// StateCache maps parameters to their last reported value.
+type StateCache map[StateKey]StateValue
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+// IsNumeric tells if the value is carried in Number rather than Text.
+func (v StateValue) IsNumeric() bool {
+	switch v.Kind {
+	case KindFloat, KindDouble, KindInt, KindLong, KindBool:
+		return true
+	}
+	return false
+}
+
+// RangeKind maps the rdfs:range of a patch parameter to the kind of value
+// it carries. Unknown ranges are treated as strings.
+func RangeKind(rangeUri string) string {
+	switch rangeUri {
+	case "http://lv2plug.in/ns/ext/atom#Float":
+		return KindFloat
+	case "http://lv2plug.in/ns/ext/atom#Double":
+		return KindDouble
+	case "http://lv2plug.in/ns/ext/atom#Int":
+		return KindInt
+	case "http://lv2plug.in/ns/ext/atom#Long":
+		return KindLong
+	case "http://lv2plug.in/ns/ext/atom#Bool":
+		return KindBool
+	case "http://lv2plug.in/ns/ext/atom#Path":
+		return KindPath
+	case "http://lv2plug.in/ns/ext/atom#URI":
+		return KindUri
+	case "http://lv2plug.in/ns/ext/atom#URID":
+		return KindUrid
+	}
+	return KindString
+}
+
+// String renders the value the same way it is sent to the plugin UI.
+func (v StateValue) String() string {
+	switch v.Kind {
+	case KindInt, KindLong, KindBool:
+		return strconv.FormatInt(int64(v.Number), 10)
+	case KindFloat:
+		return strconv.FormatFloat(v.Number, 'f', -1, 32)
+	case KindDouble:
+		return strconv.FormatFloat(v.Number, 'f', -1, 64)
+	}
+	return v.Text
+}
+
+// ParseStateValue converts a raw reported value of the given kind. An empty
+// kind is treated as float, which is what control ports carry.
+func ParseStateValue(kind string, raw string) (StateValue, error) {
+	if kind == "" {
+		kind = KindFloat
+	}
+	value := StateValue{Kind: kind, Updated: time.Now()}
+	switch kind {
+	case KindFloat, KindDouble:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return StateValue{}, fmt.Errorf("invalid %s value %q", kind, raw)
+		}
+		value.Number = f
+	case KindInt, KindLong:
+		i, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return StateValue{}, fmt.Errorf("invalid %s value %q", kind, raw)
+		}
+		value.Number = float64(i)
+	case KindBool:
+		switch raw {
+		case "1", "true":
+			value.Number = 1
+		case "0", "false":
+			value.Number = 0
+		default:
+			return StateValue{}, fmt.Errorf("invalid %s value %q", kind, raw)
+		}
+	case KindString, KindPath, KindUri, KindUrid:
+		value.Text = raw
+	default:
+		return StateValue{}, fmt.Errorf("unknown value kind %q", kind)
+	}
+	return value, nil
+}
@@ -0,0 +1,280 @@
+// =====================================================================================================
+// File:           store.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Persistent storage of server state as versioned JSON documents
+// =====================================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+// Store is a storage backend holding named documents. Names are short
+// identifiers like "aliases", backends choose how to lay them out.
+type Store interface {
+	// Get returns the stored document, errNotStored if there is none.
+	Get(name string) ([]byte, error)
+	Put(name string, data []byte) error
+	Delete(name string) error
+}
+
+// Migration converts the data of a document from one schema version to the next.
+type Migration func(data json.RawMessage) (json.RawMessage, error)
+
+// Schema of a document. Migrations[i] migrates version i to i+1, so the
+// current version is len(Migrations). Version 0 is data stored before
+// documents were versioned, kept as the bare data without envelope.
+type Schema struct {
+	Migrations []Migration
+}
+
+// Envelope a document is stored in
+type storedDocument struct {
+	Version int             `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+var errNotStored = errors.New("document not stored")
+
+// =====================================================================================================
+// Local state
+// =====================================================================================================
+
+var (
+	// Backends by the name used in MADIGAN_STORE, given the text after ':'
+	storeBackends = map[string]func(arg string) (Store, error){
+		"json":   newJSONDirStore,
+		"memory": func(string) (Store, error) { return newMemoryStore(), nil },
+	}
+
+	store   Store      = newMemoryStore() // Until main opens the configured store
+	storeMu sync.Mutex                    // Serializes load-migrate-save of documents
+
+	schemas = map[string]Schema{
+		"aliases":       {Migrations: []Migration{migrateUnversioned}},
+		"snapshots":     {Migrations: []Migration{migrateUnversioned}},
+		"last-state":    {Migrations: []Migration{migrateUnversioned}},
+		"presets":       {Migrations: []Migration{migrateUnversioned}},
+		"midi-mappings": {Migrations: []Migration{migrateUnversioned}},
+		"layouts":       {Migrations: []Migration{migrateUnversioned}},
+	}
+)
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+// JSON files in a directory, one <name>.json per document.
+type jsonDirStore struct {
+	dir string
+}
+
+func newJSONDirStore(dir string) (Store, error) {
+	if dir == "" {
+		dir = stateDir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &jsonDirStore{dir: dir}, nil
+}
+
+func (s *jsonDirStore) path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+func (s *jsonDirStore) Get(name string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotStored
+	}
+	return data, err
+}
+
+func (s *jsonDirStore) Put(name string, data []byte) error {
+	return writeFileAtomic(s.path(name), data)
+}
+
+func (s *jsonDirStore) Delete(name string) error {
+	err := os.Remove(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Documents kept in memory only, lost on restart.
+type memoryStore struct {
+	mu        sync.Mutex
+	documents map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{documents: make(map[string][]byte)}
+}
+
+func (s *memoryStore) Get(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.documents[name]
+	if !ok {
+		return nil, errNotStored
+	}
+	return data, nil
+}
+
+func (s *memoryStore) Put(name string, data []byte) error {
+	s.mu.Lock()
+	s.documents[name] = data
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) Delete(name string) error {
+	s.mu.Lock()
+	delete(s.documents, name)
+	s.mu.Unlock()
+	return nil
+}
+
+// Replace a file through a temporary file so readers never see it half written.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Open the backend named by a "<backend>[:<argument>]" spec. Falls back to
+// memory so the server still runs if the store cannot be opened.
+func openStore(spec string) Store {
+	backend, arg, _ := strings.Cut(spec, ":")
+	open, ok := storeBackends[backend]
+	if !ok {
+		log.Printf("Unknown store %q, state is not persisted", spec)
+		return newMemoryStore()
+	}
+	s, err := open(arg)
+	if err != nil {
+		log.Printf("Opening store %q failed, state is not persisted: %v", spec, err)
+		return newMemoryStore()
+	}
+	return s
+}
+
+// Open the configured store and load the state kept in it. Called from main
+// before plugin UIs and browsers are served.
+func loadState() {
+	store = openStore(storeSpec)
+	loadAliases()
+	loadLastStates()
+	loadSnapshots()
+	loadPresetMeta()
+}
+
+// Version 0 data was stored bare, its layout is the same as version 1.
+func migrateUnversioned(data json.RawMessage) (json.RawMessage, error) {
+	return data, nil
+}
+
+// Decode a stored document, bare data without envelope is version 0.
+func decodeDocument(raw []byte) storedDocument {
+	var doc storedDocument
+	var probe map[string]json.RawMessage
+	if json.Unmarshal(raw, &probe) == nil && probe["version"] != nil && probe["data"] != nil {
+		if json.Unmarshal(raw, &doc) == nil {
+			return doc
+		}
+	}
+	return storedDocument{Version: 0, Data: raw}
+}
+
+func encodeDocument(name string, data json.RawMessage) ([]byte, error) {
+	return json.MarshalIndent(storedDocument{Version: len(schemas[name].Migrations), Data: data}, "", "  ")
+}
+
+// LoadDocument decodes a stored document into v, migrating it to the
+// current schema version first. A document that was never stored leaves v
+// untouched and is not an error.
+func LoadDocument(name string, v any) error {
+	schema, ok := schemas[name]
+	if !ok {
+		return fmt.Errorf("unknown document %q", name)
+	}
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	raw, err := store.Get(name)
+	if errors.Is(err, errNotStored) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	doc := decodeDocument(raw)
+	current := len(schema.Migrations)
+	if doc.Version > current {
+		return fmt.Errorf("document %q has version %d, newer than the supported %d", name, doc.Version, current)
+	}
+	if doc.Version < current {
+		data := doc.Data
+		for version := doc.Version; version < current; version++ {
+			if data, err = schema.Migrations[version](data); err != nil {
+				return fmt.Errorf("migrating %q from version %d: %w", name, version, err)
+			}
+		}
+		log.Printf("Migrated %s from version %d to %d", name, doc.Version, current)
+		encoded, err := encodeDocument(name, data)
+		if err == nil {
+			err = store.Put(name, encoded)
+		}
+		if err != nil {
+			log.Printf("Saving migrated %s failed: %v", name, err)
+		}
+		doc.Data = data
+	}
+	return json.Unmarshal(doc.Data, v)
+}
+
+// SaveDocument stores v as the current schema version of a document.
+func SaveDocument(name string, v any) error {
+	if _, ok := schemas[name]; !ok {
+		return fmt.Errorf("unknown document %q", name)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	encoded, err := encodeDocument(name, data)
+	if err != nil {
+		return err
+	}
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	return store.Put(name, encoded)
+}
+
+// Save a document, logging failures. State is kept in memory regardless.
+func persist(name string, v any) {
+	if err := SaveDocument(name, v); err != nil {
+		log.Printf("Saving %s failed: %v", name, err)
+	}
+}
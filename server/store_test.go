@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Use a fresh memory store, and the given schema for the "test" document.
+func withTestStore(t *testing.T, schema Schema) *memoryStore {
+	t.Helper()
+	savedStore := store
+	saved, had := schemas["test"]
+	s := newMemoryStore()
+	store = s
+	schemas["test"] = schema
+	t.Cleanup(func() {
+		store = savedStore
+		if had {
+			schemas["test"] = saved
+		} else {
+			delete(schemas, "test")
+		}
+	})
+	return s
+}
+
+func storedVersion(t *testing.T, s *memoryStore, name string) int {
+	t.Helper()
+	raw, err := s.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc storedDocument
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		t.Fatalf("stored %s is not an envelope: %s", name, raw)
+	}
+	return doc.Version
+}
+
+func TestLoadDocumentMigratesUnversioned(t *testing.T) {
+	s := withTestStore(t, Schema{Migrations: []Migration{migrateUnversioned}})
+	s.Put("test", []byte(`{"synth":{"alias":"synth"}}`))
+
+	var v map[string]SavedState
+	if err := LoadDocument("test", &v); err != nil {
+		t.Fatal(err)
+	}
+	if v["synth"].Alias != "synth" {
+		t.Fatalf("unexpected data %+v", v)
+	}
+	if version := storedVersion(t, s, "test"); version != 1 {
+		t.Errorf("migrated document should be stored as version 1, got %d", version)
+	}
+}
+
+func TestLoadDocumentRunsMigrationsInOrder(t *testing.T) {
+	s := withTestStore(t, Schema{Migrations: []Migration{
+		migrateUnversioned,
+		// Version 1 held a list of names, version 2 a map by name
+		func(data json.RawMessage) (json.RawMessage, error) {
+			var names []string
+			if err := json.Unmarshal(data, &names); err != nil {
+				return nil, err
+			}
+			byName := make(map[string]bool)
+			for _, name := range names {
+				byName[name] = true
+			}
+			return json.Marshal(byName)
+		},
+	}})
+	s.Put("test", []byte(`{"version":1,"data":["a","b"]}`))
+
+	var v map[string]bool
+	if err := LoadDocument("test", &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 2 || !v["a"] || !v["b"] {
+		t.Fatalf("unexpected data %+v", v)
+	}
+	if version := storedVersion(t, s, "test"); version != 2 {
+		t.Errorf("expected version 2 stored, got %d", version)
+	}
+}
+
+func TestLoadDocumentErrors(t *testing.T) {
+	s := withTestStore(t, Schema{Migrations: []Migration{
+		migrateUnversioned,
+		func(json.RawMessage) (json.RawMessage, error) { return nil, errors.New("broken") },
+	}})
+
+	var v any
+	if err := LoadDocument("test", &v); err != nil || v != nil {
+		t.Errorf("a document never stored should load as nothing, got %v %v", v, err)
+	}
+	if err := LoadDocument("no-such-document", &v); err == nil {
+		t.Error("expected an error for an unknown document")
+	}
+
+	s.Put("test", []byte(`{"version":3,"data":{}}`))
+	if err := LoadDocument("test", &v); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("expected a newer version error, got %v", err)
+	}
+
+	s.Put("test", []byte(`{"version":1,"data":{}}`))
+	if err := LoadDocument("test", &v); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected the migration error, got %v", err)
+	}
+}
+
+func TestSaveDocument(t *testing.T) {
+	s := withTestStore(t, Schema{Migrations: []Migration{migrateUnversioned}})
+	if err := SaveDocument("test", map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if version := storedVersion(t, s, "test"); version != 1 {
+		t.Errorf("expected version 1, got %d", version)
+	}
+	var v map[string]int
+	if err := LoadDocument("test", &v); err != nil || v["a"] != 1 {
+		t.Errorf("round trip failed: %v %v", v, err)
+	}
+	if err := SaveDocument("no-such-document", 1); err == nil {
+		t.Error("expected an error for an unknown document")
+	}
+}
+
+func TestJSONDirStore(t *testing.T) {
+	s, err := newJSONDirStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("aliases"); !errors.Is(err, errNotStored) {
+		t.Errorf("expected errNotStored, got %v", err)
+	}
+	if err := s.Put("aliases", []byte("[]")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := s.Get("aliases"); err != nil || string(data) != "[]" {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if err := s.Delete("aliases"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("aliases"); err != nil {
+		t.Errorf("deleting a missing document should succeed, got %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+// =====================================================================================================
+// File:           upload.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Web server service handler storing uploaded files in the media directories
+// =====================================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+// Time allowed for one upload request, overriding the server read timeout
+const uploadTimeout = 30 * time.Minute
+
+// Outcome of one file of an upload request, the entry of a stored file or
+// the error why it was not stored
+type UploadResult struct {
+	Name string `json:"name"`
+	*FileEntry
+	Error string `json:"error,omitempty"`
+}
+
+var (
+	errTooLarge    = errors.New("file too large")
+	errFileType    = errors.New("file type not allowed")
+	errFileExists  = errors.New("file exists")
+	errBadFileName = errors.New("invalid file name")
+)
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+// Create the directories of rel below root, one level at a time so each
+// step is confined by the root.
+func mkdirAllInRoot(root *os.Root, rel string) error {
+	if rel == "." {
+		return nil
+	}
+	current := ""
+	for _, part := range strings.Split(rel, "/") {
+		current = path.Join(current, part)
+		if err := root.Mkdir(current, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func uploadFileName(name string) (string, error) {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." || strings.HasPrefix(name, ".") {
+		return "", errBadFileName
+	}
+	return name, nil
+}
+
+// Create a hidden temporary file next to rel, the listing skips it.
+func createUploadTemp(root *os.Root, rel string) (*os.File, string, error) {
+	dir, name := path.Split(rel)
+	for {
+		tmp := path.Join(dir, fmt.Sprintf(".%s.%d.upload", name, time.Now().UnixNano()))
+		f, err := root.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, tmp, err
+		}
+	}
+}
+
+// Store one uploaded file. It is written to a temporary file which is renamed
+// into place once complete, so a failed upload never touches an existing
+// file. Without overwrite the name is first reserved by creating it empty.
+func storeUpload(root *os.Root, rootDir string, dir string, name string, src io.Reader, exts map[string]bool, overwrite bool) (FileEntry, error) {
+	name, err := uploadFileName(name)
+	if err != nil {
+		return FileEntry{}, err
+	}
+	if !hasExtension(name, exts) {
+		return FileEntry{}, errFileType
+	}
+	rel := path.Join(dir, name)
+	if !overwrite {
+		reserved, err := root.OpenFile(rel, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {
+			return FileEntry{}, errFileExists
+		}
+		if err != nil {
+			return FileEntry{}, err
+		}
+		reserved.Close()
+	}
+	dst, tmp, err := createUploadTemp(root, rel)
+	if err != nil {
+		if !overwrite {
+			root.Remove(rel)
+		}
+		return FileEntry{}, err
+	}
+	n, err := io.Copy(dst, io.LimitReader(src, uploadMaxSize+1))
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n > uploadMaxSize {
+		err = errTooLarge
+	}
+	// os.Root can't rename, the directory has been checked by confinedPath
+	// and both names are plain file names in it.
+	target := filepath.Join(rootDir, filepath.FromSlash(rel))
+	if err == nil {
+		err = os.Rename(filepath.Join(rootDir, filepath.FromSlash(tmp)), target)
+	}
+	if err != nil {
+		root.Remove(tmp)
+		if !overwrite {
+			root.Remove(rel)
+		}
+		return FileEntry{}, err
+	}
+	return FileEntry{
+		Name:  name,
+		Path:  target,
+		Size:  n,
+		MTime: time.Now(),
+	}, nil
+}
+
+func uploadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errFileType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, errFileExists):
+		return http.StatusConflict
+	case errors.Is(err, errBadFileName):
+		return http.StatusBadRequest
+	}
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return fileErrorStatus(err)
+}
+
+// =====================================================================================================
+// uploadHandler
+// =====================================================================================================
+
+// Stores the files of a multipart/form-data POST in the directory given by
+// root and path, which is created if needed. Only extensions allowed by
+// MADIGAN_UPLOAD_TYPES are accepted, further narrowed by types or by the
+// file types of the patch parameter given by context and key. Existing files
+// are kept unless overwrite=true. Returns a result per file; the path of a
+// stored file can be used as value in a PATCH on /madigan-parameter with
+// type=patch. A file that fails does not undo the files stored before it,
+// the status is 207 if some files were stored and some were not, and the
+// status of the first failure if none were stored.
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	rootDir, dir, err := mediaPath(query.Get("root"), query.Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), fileErrorStatus(err))
+		return
+	}
+
+	exts := fileExtensions(uploadTypes)
+	var types []string
+	if t := query.Get("types"); t != "" {
+		types = strings.Split(t, ",")
+	} else if query.Get("context") != "" && query.Get("key") != "" {
+		types = parameterFileTypes(query.Get("context"), query.Get("key"))
+	}
+	if len(types) > 0 {
+		narrowed := make(map[string]bool)
+		for ext := range fileExtensions(types) {
+			if exts[ext] {
+				narrowed[ext] = true
+			}
+		}
+		exts = narrowed
+	}
+
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(uploadTimeout))
+	rc.SetWriteDeadline(time.Now().Add(uploadTimeout))
+	// Leave room for the multipart framing of a maximum size file
+	r.Body = http.MaxBytesReader(w, r.Body, uploadMaxSize+1<<20)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	root, err := os.OpenRoot(rootDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer root.Close()
+	dir, err = confinedPath(rootDir, dir)
+	if err != nil {
+		http.Error(w, err.Error(), fileErrorStatus(err))
+		return
+	}
+	if err := mkdirAllInRoot(root, dir); err != nil {
+		http.Error(w, err.Error(), fileErrorStatus(err))
+		return
+	}
+
+	overwrite := query.Get("overwrite") == "true"
+	results := make([]UploadResult, 0)
+	stored := 0
+	var failure error
+	fail := func(name string, err error) {
+		results = append(results, UploadResult{Name: name, Error: err.Error()})
+		if failure == nil {
+			failure = err
+		}
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The rest of the request can't be read
+			fail("", err)
+			break
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		entry, err := storeUpload(root, rootDir, dir, part.FileName(), part, exts, overwrite)
+		part.Close()
+		if err != nil {
+			log.Printf("Upload of %s failed: %v", part.FileName(), err)
+			fail(part.FileName(), err)
+			continue
+		}
+		log.Printf("Uploaded %s (%d bytes)", entry.Path, entry.Size)
+		results = append(results, UploadResult{Name: entry.Name, FileEntry: &entry})
+		stored++
+	}
+	if len(results) == 0 {
+		http.Error(w, "No file in request", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case failure == nil:
+	case stored > 0:
+		w.WriteHeader(http.StatusMultiStatus)
+	default:
+		w.WriteHeader(uploadErrorStatus(failure))
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+// =====================================================================================================
+// Init
+// =====================================================================================================
+func init() {
+	http.HandleFunc("/files/upload", uploadHandler)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Media root with an existing kick.wav, opened as os.Root.
+func testUploadRoot(t *testing.T) (*os.Root, string) {
+	t.Helper()
+	rootDir, _ := testMediaRoot(t)
+	if err := os.WriteFile(filepath.Join(rootDir, "kick.wav"), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { root.Close() })
+	defer func(saved int64) { t.Cleanup(func() { uploadMaxSize = saved }) }(uploadMaxSize)
+	uploadMaxSize = 8
+	return root, rootDir
+}
+
+// Names in dir, hidden temporary files included.
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func readFile(t *testing.T, file string) string {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStoreUpload(t *testing.T) {
+	root, rootDir := testUploadRoot(t)
+	exts := fileExtensions([]string{"audiosample"})
+	before := strings.Join(dirNames(t, rootDir), " ")
+
+	tests := []struct {
+		name      string
+		data      string
+		overwrite bool
+		err       error
+	}{
+		{"big.wav", "123456789", false, errTooLarge},
+		{"kick.wav", "new", false, errFileExists},
+		{"notes.exe", "data", false, errFileType},
+		{".hidden.wav", "data", false, errBadFileName},
+		{"big.wav", "123456789", true, errTooLarge},
+		{"kick.wav", "123456789", true, errTooLarge},
+	}
+	for _, test := range tests {
+		_, err := storeUpload(root, rootDir, ".", test.name, strings.NewReader(test.data), exts, test.overwrite)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+		// Neither the temporary file nor a reserved name is left behind
+		if after := strings.Join(dirNames(t, rootDir), " "); after != before {
+			t.Errorf("%s: directory changed from %q to %q", test.name, before, after)
+		}
+	}
+	if got := readFile(t, filepath.Join(rootDir, "kick.wav")); got != "old" {
+		t.Errorf("failed uploads changed kick.wav to %q", got)
+	}
+
+	entry, err := storeUpload(root, rootDir, "sub", "snare.wav", strings.NewReader("12345678"), exts, false)
+	if err != nil || entry.Path != filepath.Join(rootDir, "sub", "snare.wav") || entry.Size != 8 {
+		t.Fatalf("upload at the size limit: got %+v %v", entry, err)
+	}
+	if _, err := storeUpload(root, rootDir, ".", "kick.wav", strings.NewReader("new"), exts, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(rootDir, "kick.wav")); got != "new" {
+		t.Errorf("overwrite: kick.wav is %q, want new", got)
+	}
+}
+
+func uploadRequest(t *testing.T, files map[string]string, order ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, name := range order {
+		part, err := form.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(files[name]))
+	}
+	form.Close()
+	r := httptest.NewRequest(http.MethodPost, "/files/upload?root=0&path=up", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	uploadHandler(w, r)
+	return w
+}
+
+func TestUploadReportsEachFile(t *testing.T) {
+	_, rootDir := testUploadRoot(t)
+	files := map[string]string{"a.wav": "a", "b.exe": "b", "c.wav": "c"}
+
+	w := uploadRequest(t, files, "a.wav", "b.exe", "c.wav")
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("partly stored upload: got %d %s", w.Code, w.Body)
+	}
+	var results []UploadResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].FileEntry == nil || results[1].Error == "" || results[1].FileEntry != nil || results[2].FileEntry == nil {
+		t.Fatalf("expected a result per file, got %s", w.Body)
+	}
+	if names := strings.Join(dirNames(t, filepath.Join(rootDir, "up")), " "); names != "a.wav c.wav" {
+		t.Errorf("stored files: got %q, want the two accepted ones", names)
+	}
+
+	// Nothing stored, the status is that of the failure
+	if w := uploadRequest(t, files, "a.wav"); w.Code != http.StatusConflict {
+		t.Errorf("existing file: got %d %s", w.Code, w.Body)
+	}
+	if w := uploadRequest(t, files, "b.exe"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("refused type: got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,197 @@
+// =====================================================================================================
+// File:           validate.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Validation and clamping of parameter values before they are sent to a plugin UI
+// =====================================================================================================
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+// Reasons a value is rejected
+const (
+	ReasonUnknownParameter = "unknown_parameter"
+	ReasonNotANumber       = "not_a_number"
+	ReasonOutOfRange       = "out_of_range"
+	ReasonInvalidValue     = "invalid_value"
+)
+
+// Reasons a valid value was not sent to the UI
+const (
+	ReasonQueueFull = "queue_full"
+	ReasonNotSent   = "not_sent"
+)
+
+const maxMidiValue = 127
+
+// ValidationError is a rejected setting, returned to HTTP clients as a 400
+// with this structure as JSON body.
+type ValidationError struct {
+	Message string   `json:"error"`
+	Reason  string   `json:"reason"`
+	Type    string   `json:"type"`
+	Key     string   `json:"key"`
+	Value   string   `json:"value"`
+	Min     *float64 `json:"min,omitempty"`
+	Max     *float64 `json:"max,omitempty"`
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+func invalidSetting(setting Setting, reason string, format string, args ...any) *ValidationError {
+	return &ValidationError{
+		Message: fmt.Sprintf(format, args...),
+		Reason:  reason,
+		Type:    setting.Type,
+		Key:     setting.Key,
+		Value:   setting.Value,
+	}
+}
+
+func parseNumber(setting Setting) (float64, *ValidationError) {
+	f, err := strconv.ParseFloat(setting.Value, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, invalidSetting(setting, ReasonNotANumber, "%q is not a number", setting.Value)
+	}
+	return f, nil
+}
+
+// Value of the scale point nearest to f.
+func nearestPoint(points []Point, f float64) float64 {
+	nearest := float64(points[0].Value)
+	for _, point := range points[1:] {
+		if math.Abs(float64(point.Value)-f) < math.Abs(nearest-f) {
+			nearest = float64(point.Value)
+		}
+	}
+	return nearest
+}
+
+// Fit a number to the metadata of a parameter: snap enumerations to their
+// scale points, integers and rangeSteps to their grid, and clamp or reject
+// values outside min/max depending on clampValues.
+func fitNumber(setting Setting, info Info, f float64, integer bool) (float64, *ValidationError) {
+	if (info.Enum || info.Toggle) && len(info.Scale) > 0 {
+		return nearestPoint(info.Scale, f), nil
+	}
+
+	min, max := float64(info.Min), float64(info.Max)
+	if info.SampleRate {
+		min *= sampleRate
+		max *= sampleRate
+	}
+	if min < max {
+		if f < min || f > max {
+			if !clampValues {
+				e := invalidSetting(setting, ReasonOutOfRange, "%s is outside %g..%g", setting.Value, min, max)
+				e.Min, e.Max = &min, &max
+				return 0, e
+			}
+			f = math.Max(min, math.Min(max, f))
+		}
+		if info.RangeSteps > 1 {
+			step := (max - min) / float64(info.RangeSteps-1)
+			f = min + math.Round((f-min)/step)*step
+		}
+	}
+	if integer || info.Integer {
+		f = math.Round(f)
+	}
+	return f, nil
+}
+
+// ValidateSetting checks a setting against the metadata of a plugin and
+// returns the value to send, normalised and clamped.
+func ValidateSetting(all AllInfo, setting Setting) (string, error) {
+	switch setting.Type {
+	case "control":
+		info, ok := all.Param(setting.Type, setting.Key)
+		if !ok {
+			return "", invalidSetting(setting, ReasonUnknownParameter, "unknown control port %q", setting.Key)
+		}
+		f, verr := parseNumber(setting)
+		if verr != nil {
+			return "", verr
+		}
+		if f, verr = fitNumber(setting, info, f, false); verr != nil {
+			return "", verr
+		}
+		return strconv.FormatFloat(f, 'f', -1, 32), nil
+
+	case "midicc":
+		cc, err := strconv.Atoi(setting.Key)
+		if err != nil || cc < 0 || cc > maxMidiValue {
+			return "", invalidSetting(setting, ReasonUnknownParameter, "MIDI CC number %q is not in 0..127", setting.Key)
+		}
+		f, verr := parseNumber(setting)
+		if verr != nil {
+			return "", verr
+		}
+		info, ok := all.Param(setting.Type, setting.Key)
+		if !ok {
+			info = Info{Min: 0, Max: maxMidiValue}
+		}
+		info.Min = float32(math.Max(float64(info.Min), 0))
+		info.Max = float32(math.Min(float64(info.Max), maxMidiValue))
+		if f, verr = fitNumber(setting, info, f, true); verr != nil {
+			return "", verr
+		}
+		return strconv.Itoa(int(f)), nil
+
+	case "patch":
+		info, ok := all.Param(setting.Type, setting.Key)
+		if !ok {
+			return "", invalidSetting(setting, ReasonUnknownParameter, "unknown patch parameter %q", setting.Key)
+		}
+		kind := RangeKind(info.Range)
+		switch kind {
+		case KindFloat, KindDouble, KindInt, KindLong:
+			f, verr := parseNumber(setting)
+			if verr != nil {
+				return "", verr
+			}
+			if f, verr = fitNumber(setting, info, f, kind == KindInt || kind == KindLong); verr != nil {
+				return "", verr
+			}
+			return StateValue{Kind: kind, Number: f}.String(), nil
+		}
+		value, err := ParseStateValue(kind, setting.Value)
+		if err != nil {
+			return "", invalidSetting(setting, ReasonInvalidValue, "%s", err.Error())
+		}
+		if (kind == KindUri || kind == KindUrid || kind == KindPath) && value.Text == "" {
+			return "", invalidSetting(setting, ReasonInvalidValue, "empty %s value", kind)
+		}
+		return value.String(), nil
+	}
+	return "", invalidSetting(setting, ReasonUnknownParameter, "unknown parameter type %q", setting.Type)
+}
+
+// Answer a request with a validation error as a structured 400.
+func writeValidationError(w http.ResponseWriter, err error) {
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		verr = &ValidationError{Message: err.Error(), Reason: ReasonInvalidValue}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(verr)
+}
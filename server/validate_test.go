@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func validationInfo() AllInfo {
+	return AllInfo{
+		ControlInput: []Info{
+			{Index: "0", Input: true, Control: true, Min: 0, Max: 10},
+			{Index: "1", Input: true, Control: true, Min: 0, Max: 10, Enum: true, Scale: []Point{{Label: "a", Value: 1}, {Label: "b", Value: 5}, {Label: "c", Value: 9}}},
+			{Index: "2", Input: true, Control: true, Min: 0, Max: 1, RangeSteps: 5},
+			{Index: "3", Input: true, Control: true, Min: -5, Max: 5, Integer: true},
+			{Index: "4", Input: true, Control: true, Min: 0, Max: 0.5, SampleRate: true},
+			{Index: "5", Input: true, Control: true, Min: 0, Max: 1, Toggle: true, Scale: []Point{{Value: 0}, {Value: 1}}},
+		},
+		MidiParameter: []Info{
+			{Midicc: "7", Min: 0, Max: 100},
+		},
+		PatchParameter: []Info{
+			{Uri: "urn:test#int", Range: "http://lv2plug.in/ns/ext/atom#Int", Min: 0, Max: 10},
+			{Uri: "urn:test#bool", Range: "http://lv2plug.in/ns/ext/atom#Bool"},
+			{Uri: "urn:test#path", Range: "http://lv2plug.in/ns/ext/atom#Path"},
+			{Uri: "urn:test#name", Range: "http://lv2plug.in/ns/ext/atom#String"},
+		},
+	}
+}
+
+func TestValidateSetting(t *testing.T) {
+	defer func(clamp bool, rate float64) { clampValues, sampleRate = clamp, rate }(clampValues, sampleRate)
+	clampValues = true
+	sampleRate = 48000
+
+	cases := []struct {
+		typ, key, value string
+		want            string
+	}{
+		{"control", "0", "5.5", "5.5"},
+		{"control", "0", "12", "10"},
+		{"control", "0", "-3", "0"},
+		{"control", "1", "3.8", "5"},
+		{"control", "1", "100", "9"},
+		{"control", "2", "0.3", "0.25"},
+		{"control", "2", "0.9", "1"},
+		{"control", "3", "2.6", "3"},
+		{"control", "3", "-9", "-5"},
+		{"control", "4", "30000", "24000"},
+		{"control", "5", "0.7", "1"},
+		{"midicc", "7", "120", "100"},
+		{"midicc", "8", "200", "127"},
+		{"midicc", "8", "63.6", "64"},
+		{"patch", "urn:test#int", "3.6", "4"},
+		{"patch", "urn:test#int", "11", "10"},
+		{"patch", "urn:test#bool", "true", "1"},
+		{"patch", "urn:test#path", "/tmp/a.wav", "/tmp/a.wav"},
+		{"patch", "urn:test#name", "any text", "any text"},
+	}
+	info := validationInfo()
+	for _, c := range cases {
+		got, err := ValidateSetting(info, Setting{Type: c.typ, Key: c.key, Value: c.value})
+		if err != nil || got != c.want {
+			t.Errorf("%s %s %q: got %q, %v; want %q", c.typ, c.key, c.value, got, err, c.want)
+		}
+	}
+}
+
+func TestValidateSettingRejects(t *testing.T) {
+	defer func(clamp bool) { clampValues = clamp }(clampValues)
+	clampValues = true
+
+	cases := []struct {
+		typ, key, value string
+		reason          string
+	}{
+		{"control", "99", "1", ReasonUnknownParameter},
+		{"control", "0", "loud", ReasonNotANumber},
+		{"control", "0", "NaN", ReasonNotANumber},
+		{"control", "0", "Inf", ReasonNotANumber},
+		{"midicc", "128", "1", ReasonUnknownParameter},
+		{"midicc", "x", "1", ReasonUnknownParameter},
+		{"patch", "urn:test#none", "1", ReasonUnknownParameter},
+		{"patch", "urn:test#path", "", ReasonInvalidValue},
+		{"other", "1", "1", ReasonUnknownParameter},
+	}
+	info := validationInfo()
+	for _, c := range cases {
+		_, err := ValidateSetting(info, Setting{Type: c.typ, Key: c.key, Value: c.value})
+		var verr *ValidationError
+		if !errors.As(err, &verr) || verr.Reason != c.reason {
+			t.Errorf("%s %s %q: got %v, want reason %s", c.typ, c.key, c.value, err, c.reason)
+			continue
+		}
+		if verr.Type != c.typ || verr.Key != c.key || verr.Value != c.value {
+			t.Errorf("%s %s %q: error does not name the setting: %+v", c.typ, c.key, c.value, verr)
+		}
+	}
+}
+
+func TestValidateSettingWithoutClamping(t *testing.T) {
+	defer func(clamp bool) { clampValues = clamp }(clampValues)
+	clampValues = false
+
+	_, err := ValidateSetting(validationInfo(), Setting{Type: "control", Key: "0", Value: "12"})
+	var verr *ValidationError
+	if !errors.As(err, &verr) || verr.Reason != ReasonOutOfRange {
+		t.Fatalf("expected out of range, got %v", err)
+	}
+	if verr.Min == nil || verr.Max == nil || *verr.Min != 0 || *verr.Max != 10 {
+		t.Errorf("expected the range in the error, got %+v", verr)
+	}
+	if got, err := ValidateSetting(validationInfo(), Setting{Type: "control", Key: "0", Value: "10"}); err != nil || got != "10" {
+		t.Errorf("in range value: got %q, %v", got, err)
+	}
+}
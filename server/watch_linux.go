@@ -0,0 +1,122 @@
+// =====================================================================================================
+// File:           watch_linux.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    inotify based watching of LV2 bundle directories
+// =====================================================================================================
+
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+const (
+	watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+		syscall.IN_CLOSE_WRITE | syscall.IN_DELETE_SELF
+
+	// Changes are collected for this long before a rescan is made
+	watchSettle = 2 * time.Second
+)
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+// Watch the LV2 directories and the bundles directly below them and call
+// rescan when something has changed. Runs until the inotify descriptor fails.
+func watchLV2Dirs(roots []string, rescan func()) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		log.Println("LV2 path watch disabled:", err)
+		return
+	}
+	defer syscall.Close(fd)
+
+	dirs := make(map[int32]string)
+	isRoot := make(map[string]bool)
+	add := func(dir string) {
+		wd, err := syscall.InotifyAddWatch(fd, dir, watchMask)
+		if err != nil {
+			return
+		}
+		dirs[int32(wd)] = dir
+	}
+	for _, root := range roots {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		isRoot[root] = true
+		add(root)
+		for _, entry := range entries {
+			if entry.IsDir() {
+				add(filepath.Join(root, entry.Name()))
+			}
+		}
+	}
+	if len(dirs) == 0 {
+		log.Println("LV2 path watch disabled: no directories to watch")
+		return
+	}
+	log.Printf("Watching %d LV2 directories for changes", len(dirs))
+
+	changed := make(chan struct{}, 1)
+	go func() {
+		var timer <-chan time.Time
+		for {
+			select {
+			case <-changed:
+				timer = time.After(watchSettle)
+			case <-timer:
+				timer = nil
+				log.Println("LV2 directories changed, rescanning")
+				rescan()
+			}
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			log.Println("LV2 path watch stopped:", err)
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			name := string(bytes.TrimRight(nameBytes, "\x00"))
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			dir := dirs[event.Wd]
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(dirs, event.Wd)
+				continue
+			}
+			if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && isRoot[dir] {
+				add(filepath.Join(dir, name))
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
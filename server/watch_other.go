@@ -0,0 +1,17 @@
+// =====================================================================================================
+// File:           watch_other.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    LV2 directory watching on platforms without inotify
+// =====================================================================================================
+
+//go:build !linux
+
+package main
+
+import "log"
+
+func watchLV2Dirs(roots []string, rescan func()) {
+	log.Println("LV2 path watch is only supported on Linux, use /rescan instead")
+}
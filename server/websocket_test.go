@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+// Client side of a WebSocket over net.Pipe
+type testClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestSocket(t *testing.T) (*WebSocket, *testClient) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	ws := newWebSocket(server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)))
+	return ws, &testClient{conn: client, r: bufio.NewReader(client)}
+}
+
+// Frame as a client sends it, masked.
+func clientFrame(fin bool, opcode byte, payload []byte) []byte {
+	var b bytes.Buffer
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	b.WriteByte(first)
+	switch {
+	case len(payload) < 126:
+		b.WriteByte(0x80 | byte(len(payload)))
+	case len(payload) <= 0xffff:
+		b.WriteByte(0x80 | 126)
+		binary.Write(&b, binary.BigEndian, uint16(len(payload)))
+	default:
+		b.WriteByte(0x80 | 127)
+		binary.Write(&b, binary.BigEndian, uint64(len(payload)))
+	}
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	b.Write(mask[:])
+	for i, c := range payload {
+		b.WriteByte(c ^ mask[i%4])
+	}
+	return b.Bytes()
+}
+
+func (c *testClient) send(t *testing.T, frames ...[]byte) {
+	t.Helper()
+	go func() {
+		for _, frame := range frames {
+			if _, err := c.conn.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Read an unmasked server frame.
+func (c *testClient) read(t *testing.T) (bool, byte, []byte) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	if head[1]&0x80 != 0 {
+		t.Fatal("server frame is masked")
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.r, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.r, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0]&0x80 != 0, head[0] & 0x0f, payload
+}
+
+func TestWebSocketReadMasked(t *testing.T) {
+	ws, client := newTestSocket(t)
+	client.send(t, clientFrame(true, wsOpText, []byte("hello")))
+	op, message, err := ws.ReadMessage()
+	if err != nil || op != wsOpText || string(message) != "hello" {
+		t.Fatalf("got %d %q %v", op, message, err)
+	}
+}
+
+func TestWebSocketReadExtendedLengths(t *testing.T) {
+	for _, n := range []int{125, 126, 0xffff, 0x10000} {
+		ws, client := newTestSocket(t)
+		payload := bytes.Repeat([]byte{'x'}, n)
+		client.send(t, clientFrame(true, wsOpBinary, payload))
+		op, message, err := ws.ReadMessage()
+		if err != nil || op != wsOpBinary || !bytes.Equal(message, payload) {
+			t.Fatalf("length %d: got %d, %d bytes, %v", n, op, len(message), err)
+		}
+	}
+}
+
+func TestWebSocketFragmentsWithInterleavedPing(t *testing.T) {
+	ws, client := newTestSocket(t)
+	client.send(t,
+		clientFrame(false, wsOpText, []byte("hel")),
+		clientFrame(true, wsOpPing, []byte("p")),
+		clientFrame(true, wsOpContinuation, []byte("lo")))
+
+	done := make(chan struct{})
+	var op byte
+	var message []byte
+	var err error
+	go func() {
+		op, message, err = ws.ReadMessage()
+		close(done)
+	}()
+	fin, pongOp, pong := client.read(t)
+	if !fin || pongOp != wsOpPong || string(pong) != "p" {
+		t.Fatalf("expected pong, got %v %d %q", fin, pongOp, pong)
+	}
+	<-done
+	if err != nil || op != wsOpText || string(message) != "hello" {
+		t.Fatalf("got %d %q %v", op, message, err)
+	}
+}
+
+func TestWebSocketCloseHandshake(t *testing.T) {
+	ws, client := newTestSocket(t)
+	client.send(t, clientFrame(true, wsOpClose, []byte{0x03, 0xe8}))
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := ws.ReadMessage()
+		errc <- err
+	}()
+	_, op, payload := client.read(t)
+	if op != wsOpClose || !bytes.Equal(payload, []byte{0x03, 0xe8}) {
+		t.Fatalf("expected close echo, got %d %v", op, payload)
+	}
+	if err := <-errc; !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestWebSocketRejectsBadFrames(t *testing.T) {
+	unmasked := []byte{0x81, 0x02, 'h', 'i'}
+	cases := map[string][]byte{
+		"unmasked":           unmasked,
+		"fragmented control": clientFrame(false, wsOpPing, nil),
+		"oversize control":   clientFrame(true, wsOpPing, bytes.Repeat([]byte{'x'}, 126)),
+		"stray continuation": clientFrame(true, wsOpContinuation, []byte("x")),
+		"unknown opcode":     clientFrame(true, 0x3, nil),
+	}
+	for name, frame := range cases {
+		ws, client := newTestSocket(t)
+		client.send(t, frame)
+		if _, _, err := ws.ReadMessage(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestWebSocketWriteLengths(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		ws, client := newTestSocket(t)
+		payload := bytes.Repeat([]byte{'y'}, n)
+		go ws.WriteMessage(wsOpBinary, payload)
+		fin, op, got := client.read(t)
+		if !fin || op != wsOpBinary || !bytes.Equal(got, payload) {
+			t.Fatalf("length %d: got %v %d, %d bytes", n, fin, op, len(got))
+		}
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	defer func(saved []string) { allowedOrigins = saved }(allowedOrigins)
+	allowedOrigins = []string{"http://studio.local:8080"}
+
+	cases := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://localhost:17000", true},
+		{"http://studio.local:8080", true},
+		{"http://evil.example", false},
+		{"http://localhost:9999", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "http://localhost:17000/madigan-parameter/ws", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if got := originAllowed(r); got != c.want {
+			t.Errorf("origin %q: got %v, want %v", c.origin, got, c.want)
+		}
+	}
+}
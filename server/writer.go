@@ -0,0 +1,105 @@
+// =====================================================================================================
+// File:           writer.go
+// Project:        madigan
+// Author:         Lars-Erik Helander <lehswel@gmail.com>
+// License:        MIT
+// Description:    Single writer per UI socket so frames from concurrent senders never interleave
+// =====================================================================================================
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// =====================================================================================================
+// Types & constants
+// =====================================================================================================
+
+var (
+	ErrQueueFull = errors.New("send queue to plugin UI is full")
+	ErrPeerGone  = errors.New("plugin UI connection is closed")
+)
+
+// =====================================================================================================
+// Local functions
+// =====================================================================================================
+
+// Start the writer of a new connection.
+func (conn *UIConnection) startWriter() {
+	conn.writes = make(chan []byte, writeQueueLen)
+	conn.done = make(chan struct{})
+	go conn.writer()
+}
+
+// Writes queued frames one at a time until the connection is shut down. A
+// failed or timed out write closes the socket, which ends the read loop.
+func (conn *UIConnection) writer() {
+	for {
+		select {
+		case payload := <-conn.writes:
+			conn.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := SendMessage(conn.Conn, payload); err != nil {
+				log.Printf("Write to %s failed: %v", conn.Id, err)
+				conn.shutdown()
+				conn.Conn.Close()
+				return
+			}
+			conn.sent.Add(1)
+			conn.touch()
+		case <-conn.done:
+			return
+		}
+	}
+}
+
+// Stop the writer. Frames still queued are dropped.
+func (conn *UIConnection) shutdown() {
+	conn.closeOnce.Do(func() { close(conn.done) })
+}
+
+func (conn *UIConnection) closed() bool {
+	select {
+	case <-conn.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Queue a frame for the writer. Without wait a full queue is an error.
+func (conn *UIConnection) write(payload []byte, wait bool) error {
+	if conn.closed() {
+		return ErrPeerGone
+	}
+	if wait {
+		select {
+		case conn.writes <- payload:
+			return nil
+		case <-conn.done:
+			return ErrPeerGone
+		}
+	}
+	select {
+	case conn.writes <- payload:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// HTTP status for an error sending to a plugin UI.
+func sendErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNoConnection):
+		return http.StatusNotFound
+	case errors.Is(err, ErrPeerGone):
+		return http.StatusBadGateway
+	case errors.Is(err, ErrQueueFull):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
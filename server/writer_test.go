@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWriterQueueFull(t *testing.T) {
+	defer func(saved int64) { writeQueueLen = saved }(writeQueueLen)
+	writeQueueLen = 2
+	ui := connectTestUI(t, "writer-full", ProtocolJSON, testInfo())
+
+	// The peer does not read, the writer blocks on the first frame and the
+	// queue fills up behind it
+	var err error
+	sent := 0
+	for ; sent < 10; sent++ {
+		if _, err = ui.conn.Send(Message{"cmd": "set", "type": "control", "key": "1", "value": "0.5"}); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrQueueFull) || sendErrorStatus(err) != http.StatusServiceUnavailable {
+		t.Fatalf("expected %v after filling the queue, got %v after %d sends", ErrQueueFull, err, sent)
+	}
+	if sent < 2 || sent > 3 {
+		t.Errorf("queue of 2 behind a blocked write took %d frames", sent)
+	}
+
+	for i := 0; i < sent; i++ {
+		ui.next(t)
+	}
+	if _, err := ui.conn.Send(Message{"cmd": "set", "type": "control", "key": "1", "value": "0.75"}); err != nil {
+		t.Fatalf("send after the peer caught up: %v", err)
+	}
+	if m := ui.next(t); m["value"] != "0.75" {
+		t.Errorf("expected the later set, got %v", m)
+	}
+}
+
+func TestWriterStalledPeerIsGone(t *testing.T) {
+	defer func(saved time.Duration) { writeTimeout = saved }(writeTimeout)
+	writeTimeout = 20 * time.Millisecond
+	ui := connectTestUI(t, "writer-stalled", ProtocolJSON, testInfo())
+
+	if _, err := ui.conn.Send(Message{"cmd": "get", "type": "control", "key": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ui.conn.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("a write timing out should end the connection")
+	}
+	_, err := ui.conn.Send(Message{"cmd": "get", "type": "control", "key": "1"})
+	if !errors.Is(err, ErrPeerGone) || sendErrorStatus(err) != http.StatusBadGateway {
+		t.Fatalf("expected %v once the writer stopped, got %v", ErrPeerGone, err)
+	}
+	if err := ui.conn.write([]byte("{}"), true); !errors.Is(err, ErrPeerGone) {
+		t.Fatalf("a waiting write should fail with %v, got %v", ErrPeerGone, err)
+	}
+}